@@ -0,0 +1,139 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/viper"
+)
+
+// accountProfile says how to act in another account. Profiles are read from
+// the accounts section of the config file, keyed by an alias that can be
+// used wherever an account ID is expected, e.g.
+//
+//   mfa-serial: arn:aws:iam::111111111111:mfa/me
+//   accounts:
+//     prod:
+//       id: "222222222222"
+//       role-arn: arn:aws:iam::222222222222:role/ami-automation
+//       external-id: secret
+//       session-name: ami-automation
+type accountProfile struct {
+	Id          string `mapstructure:"id"`
+	RoleArn     string `mapstructure:"role-arn"`
+	ExternalId  string `mapstructure:"external-id"`
+	SessionName string `mapstructure:"session-name"`
+}
+
+func accountProfiles() map[string]accountProfile {
+	profiles := map[string]accountProfile{}
+	viper.UnmarshalKey("accounts", &profiles)
+	return profiles
+}
+
+// accountProfileFor looks up an account by alias or ID.
+func accountProfileFor(account string) (accountProfile, bool) {
+	profiles := accountProfiles()
+
+	if profile, ok := profiles[account]; ok {
+		return profile, true
+	}
+
+	for _, profile := range profiles {
+		if profile.Id == account {
+			return profile, true
+		}
+	}
+
+	return accountProfile{}, false
+}
+
+// resolveAccount turns an account alias into its ID. Anything else is
+// returned as is.
+func resolveAccount(account string) string {
+	if profile, ok := accountProfileFor(account); ok && len(profile.Id) > 0 {
+		return profile.Id
+	}
+	return account
+}
+
+var accountCreds = struct {
+	sync.Mutex
+	mfa   *session.Session
+	creds map[string]*credentials.Credentials
+}{creds: map[string]*credentials.Credentials{}}
+
+// assumeRoleSession returns a session that acts as roleArn (or the role in
+// account's profile, if it has one). Credentials are cached for the life of
+// the process so each role is only assumed once, and if mfa-serial is
+// configured, the MFA code is only asked for once, however many accounts are
+// involved.
+func assumeRoleSession(sess *session.Session, account, roleArn string) (*session.Session, error) {
+	profile, hasProfile := accountProfileFor(account)
+	if hasProfile && len(profile.RoleArn) > 0 {
+		roleArn = profile.RoleArn
+	}
+
+	accountCreds.Lock()
+	defer accountCreds.Unlock()
+
+	key := roleArn + "|" + profile.ExternalId
+	creds, ok := accountCreds.creds[key]
+
+	if !ok {
+		base, err := mfaSession(sess)
+		if err != nil { return nil, err }
+
+		creds = stscreds.NewCredentials(base, roleArn, func(p *stscreds.AssumeRoleProvider) {
+			if len(profile.ExternalId) > 0 {
+				p.ExternalID = aws.String(profile.ExternalId)
+			}
+			if len(profile.SessionName) > 0 {
+				p.RoleSessionName = profile.SessionName
+			}
+		})
+		accountCreds.creds[key] = creds
+	}
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// mfaSession exchanges an MFA code for session credentials the first time
+// it's called, when mfa-serial is configured. Must be called with
+// accountCreds locked.
+func mfaSession(sess *session.Session) (*session.Session, error) {
+	serial := viper.GetString("mfa-serial")
+	if len(serial) == 0 { return sess, nil }
+	if accountCreds.mfa != nil { return accountCreds.mfa, nil }
+
+	code, err := stscreds.StdinTokenProvider()
+	if err != nil { return nil, err }
+
+	resp, err := sts.New(sess).GetSessionToken(&sts.GetSessionTokenInput{
+		SerialNumber: aws.String(serial),
+		TokenCode:    aws.String(code),
+	})
+	if err != nil { return nil, err }
+
+	creds := credentials.NewStaticCredentials(*resp.Credentials.AccessKeyId, *resp.Credentials.SecretAccessKey, *resp.Credentials.SessionToken)
+	accountCreds.mfa = sess.Copy(&aws.Config{Credentials: creds})
+	return accountCreds.mfa, nil
+}
@@ -0,0 +1,212 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/fatih/color"
+	"github.com/glassechidna/ami-automation/shared"
+	"github.com/spf13/cobra"
+)
+
+var approveCmd = &cobra.Command{
+	Use:   "approve EXEC_ID",
+	Short: "Approve an SSM automation execution waiting on an aws:approve step",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		comment, _ := cmd.PersistentFlags().GetString("comment")
+		exitOnError(sendApproval(awsSession(), args[0], ssm.SignalTypeApprove, comment))
+	},
+}
+
+var rejectCmd = &cobra.Command{
+	Use:   "reject EXEC_ID",
+	Short: "Reject an SSM automation execution waiting on an aws:approve step",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		comment, _ := cmd.PersistentFlags().GetString("comment")
+		exitOnError(sendApproval(awsSession(), args[0], ssm.SignalTypeReject, comment))
+	},
+}
+
+// sendApproval approves or rejects the execution's waiting aws:approve step.
+func sendApproval(sess *session.Session, execId, signal, comment string) error {
+	input := &ssm.SendAutomationSignalInput{
+		AutomationExecutionId: &execId,
+		SignalType:            &signal,
+	}
+
+	if len(comment) > 0 {
+		input.Payload = map[string][]*string{"Comment": {aws.String(comment)}}
+	}
+
+	_, err := ssm.New(sess).SendAutomationSignal(input)
+	if err != nil { return err }
+
+	color.New(color.FgBlue).Fprintf(os.Stderr, "Sent %s to %s\n", signal, execId)
+	return nil
+}
+
+// stdinIsTerminal reports whether we can prompt the user for input.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil { return false }
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// approvalHandler returns the StatusReporter hook for steps that are waiting
+// on an approval. On a terminal, callers that are one of the step's approvers
+// are prompted to approve or reject it; everyone else is told how to do it.
+func approvalHandler(sess *session.Session, execId string) shared.WaitingHandler {
+	return func(step *ssm.StepExecution) {
+		if aws.StringValue(step.Action) != "aws:approve" { return }
+
+		yellow := color.New(color.FgYellow)
+		yellow.Fprintf(os.Stderr, "%s is waiting for approval\n", *step.StepName)
+		if message := stepInputString(step, "Message"); len(message) > 0 {
+			yellow.Fprintln(os.Stderr, message)
+		}
+
+		hint := func() {
+			yellow.Fprintf(os.Stderr, "Run '%s approve %s' or '%s reject %s' to continue\n", os.Args[0], execId, os.Args[0], execId)
+		}
+
+		if !stdinIsTerminal() {
+			hint()
+			return
+		}
+
+		approver, err := callerIsApprover(sess, stepInputList(step, "Approvers"))
+		if err != nil || !approver {
+			hint()
+			return
+		}
+
+		signal, comment := promptApproval()
+		if len(signal) == 0 {
+			hint()
+			return
+		}
+
+		if err := sendApproval(sess, execId, signal, comment); err != nil {
+			color.New(color.FgRed).Fprintln(os.Stderr, err.Error())
+			hint()
+		}
+	}
+}
+
+// promptApproval asks the user whether to approve or reject, returning an
+// empty signal if they'd rather decide later.
+func promptApproval() (string, string) {
+	reader := bufio.NewReader(os.Stdin)
+
+	for {
+		fmt.Fprint(os.Stderr, "Approve, reject or decide later? [a/r/l]: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil { return "", "" }
+
+		signal := ""
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "a", "approve":
+			signal = ssm.SignalTypeApprove
+		case "r", "reject":
+			signal = ssm.SignalTypeReject
+		case "l", "later":
+			return "", ""
+		default:
+			continue
+		}
+
+		fmt.Fprint(os.Stderr, "Comment (optional): ")
+		comment, _ := reader.ReadString('\n')
+		return signal, strings.TrimSpace(comment)
+	}
+}
+
+// callerIsApprover checks whether the current credentials belong to one of the
+// approvers, which can be IAM user or role ARNs, or just their names.
+func callerIsApprover(sess *session.Session, approvers []string) (bool, error) {
+	resp, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil { return false, err }
+
+	for _, identity := range callerIdentities(*resp.Account, *resp.Arn) {
+		if stringInSlice(identity, approvers) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// callerIdentities lists the ways an approver list could refer to the caller.
+// Assumed role sessions are referred to by the role they are a session of.
+func callerIdentities(account, arn string) []string {
+	identities := []string{arn}
+
+	// arn:aws:sts::123456789012:assumed-role/RoleName/SessionName
+	// arn:aws:iam::123456789012:user/path/UserName
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 { return identities }
+
+	resource := strings.Split(parts[5], "/")
+	switch resource[0] {
+	case "assumed-role":
+		if len(resource) < 2 { break }
+		role := resource[1]
+		identities = append(identities, fmt.Sprintf("arn:%s:iam::%s:role/%s", parts[1], account, role), role)
+	case "user":
+		identities = append(identities, resource[len(resource)-1])
+	}
+
+	return identities
+}
+
+// stepInputString returns a step input, which SSM gives as JSON, as a string.
+func stepInputString(step *ssm.StepExecution, name string) string {
+	raw := aws.StringValue(step.Inputs[name])
+	if unquoted, err := strconv.Unquote(raw); err == nil {
+		return unquoted
+	}
+	return raw
+}
+
+// stepInputList returns a step input that is a list of strings.
+func stepInputList(step *ssm.StepExecution, name string) []string {
+	list := []string{}
+	raw := aws.StringValue(step.Inputs[name])
+
+	if err := json.Unmarshal([]byte(raw), &list); err != nil && len(raw) > 0 {
+		list = []string{stepInputString(step, name)}
+	}
+
+	return list
+}
+
+func init() {
+	RootCmd.AddCommand(approveCmd)
+	RootCmd.AddCommand(rejectCmd)
+	approveCmd.PersistentFlags().String("comment", "", "(optional) comment recorded with the approval")
+	rejectCmd.PersistentFlags().String("comment", "", "(optional) comment recorded with the rejection")
+}
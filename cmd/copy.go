@@ -21,41 +21,216 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"os"
 	"github.com/fatih/color"
+	"sync"
+	"fmt"
+	"strings"
+	"github.com/glassechidna/ami-automation/shared"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"text/template"
+	"time"
+	"github.com/aws/aws-sdk-go/service/kms"
 )
 
 var copyCmd = &cobra.Command{
 	Use:   "copy",
 	Short: "A brief description of your command",
 	Run: func(cmd *cobra.Command, args []string) {
-		amiId, _ := cmd.PersistentFlags().GetString("image-id")
-		regions, _ := cmd.PersistentFlags().GetStringSlice("region")
-		shouldWait, _ := cmd.PersistentFlags().GetBool("wait")
+		viper.BindPFlags(cmd.PersistentFlags())
+
+		amiId := viper.GetString("image-id")
+		shouldWait := viper.GetBool("wait")
+
+		opts, err := newCopyOptions()
+		exitOnError(err)
 
 		sess := awsSession()
-		amiIds := copyAmiUi(sess, amiId, regions)
+
+		regions, err := resolveRegions(sess, viper.GetStringSlice("region"), viper.GetStringSlice("exclude-region"))
+		exitOnError(err)
+		amiIds, err := copyAmiUi(sess, amiId, regions, opts)
+		rollbackOnError(sess, opts, err)
 
 		if shouldWait {
 			color.New(color.FgBlue).Fprintln(os.Stderr, "Waiting for copied AMIs to be available")
-			wait(sess, amiIds)
+			rollbackOnError(sess, opts, wait(sess, amiLists(amiIds), opts.concurrency, opts.waitTimeout))
+
+			_, err := snapshotEncryptionUi(sess, amiIds)
+			exitOnError(err)
 		}
 	},
 }
 
-type copyAmiResult struct {
-	region string
-	resp *ec2.CopyImageOutput
-	err error
+// sourceAmiTag is written to every copy (and its snapshots) so that a re-run
+// can find and reuse the copies it made last time.
+const sourceAmiTag = "ami-automation:source-ami"
+
+type copyOptions struct {
+	// concurrency is the maximum number of regions copied to at once
+	concurrency int
+	// encrypt requests that every regional copy is encrypted, using the
+	// region's default EBS key unless kmsKeys has an entry for it
+	encrypt bool
+	// kmsKeys maps region names to the KMS key to encrypt copies with there
+	kmsKeys map[string]string
+	// tagInclude and tagExclude select which of the source AMI's tags are
+	// copied, by key
+	tagInclude []string
+	tagExclude []string
+	// tags are applied to every copy (and its snapshots) on top of the
+	// copied ones
+	tags map[string]string
+	nameTemplate *template.Template
+	descriptionTemplate *template.Template
+	// journal records the copies made (not reused) by this run, which are
+	// deregistered if a later step fails unless keepPartial is set
+	journal *copyJournal
+	keepPartial bool
+	// waitTimeout is how long to wait for copies to become available
+	waitTimeout time.Duration
+}
+
+// addCopyFlags defines the flags shared by every command that copies AMIs.
+func addCopyFlags(flags *pflag.FlagSet) {
+	flags.Int("concurrency", 4, "Maximum number of regions to copy to (or poll while waiting) at once")
+	flags.Bool("encrypt", false, "Encrypt copied images (with the region's default EBS key unless --kms-key is given)")
+	flags.StringSlice("kms-key", []string{""}, "(optional, multiple) region=key-arn KMS key to encrypt copies with in that region")
+	flags.StringSlice("tag", []string{""}, "(optional, multiple) key=value tag to add to copied images and their snapshots")
+	flags.StringSlice("tag-include", []string{"*"}, "(optional, multiple) patterns of source image tag keys to copy")
+	flags.StringSlice("tag-exclude", []string{""}, "(optional, multiple) patterns of source image tag keys not to copy")
+	flags.String("name-template", "{{.Name}}", "Template for copied image names, e.g. {{.Name}}-{{.Region}}")
+	flags.String("description-template", "{{.Description}}", "Template for copied image descriptions")
+	flags.Bool("keep-partial", false, "Don't deregister the AMIs copied by this run if a copy, wait or share fails")
+	flags.Duration("wait-timeout", 2 * time.Hour, "Give up if copied AMIs aren't available after this long (0 to wait forever)")
+}
+
+// newCopyOptions reads the flags defined by addCopyFlags (or their config
+// file equivalents) from viper.
+func newCopyOptions() (copyOptions, error) {
+	opts := copyOptions{
+		concurrency: viper.GetInt("concurrency"),
+		encrypt: viper.GetBool("encrypt"),
+		tagInclude: nonEmpty(viper.GetStringSlice("tag-include")),
+		tagExclude: nonEmpty(viper.GetStringSlice("tag-exclude")),
+		journal: newCopyJournal(),
+		keepPartial: viper.GetBool("keep-partial"),
+		waitTimeout: viper.GetDuration("wait-timeout"),
+	}
+
+	var err error
+
+	opts.kmsKeys, err = parseKeyValues(viper.GetStringSlice("kms-key"))
+	if err != nil { return opts, err }
+
+	opts.tags, err = parseKeyValues(viper.GetStringSlice("tag"))
+	if err != nil { return opts, err }
+
+	opts.nameTemplate, err = template.New("name").Parse(viper.GetString("name-template"))
+	if err != nil { return opts, err }
+
+	opts.descriptionTemplate, err = template.New("description").Parse(viper.GetString("description-template"))
+	if err != nil { return opts, err }
+
+	return opts, nil
+}
+
+// validate checks that every target region has a KMS key if any were given,
+// as a half-configured mapping would otherwise silently fall back to the
+// default key.
+func (o copyOptions) validate(regions []string) error {
+	if len(o.kmsKeys) == 0 { return nil }
+
+	missing := []string{}
+	for _, region := range regions {
+		if _, ok := o.kmsKeys[region]; !ok {
+			missing = append(missing, region)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("no KMS key configured for region(s): %s", strings.Join(missing, ", "))
+	}
+	return nil
 }
 
-func copyAmiUi(sess *session.Session, amiId string, regions []string) map[string]string {
+// copyInput builds the CopyImage request for one target region.
+func (o copyOptions) copyInput(source *ec2.Image, sourceRegion, region string) (*ec2.CopyImageInput, error) {
+	data := copyTemplateData{
+		Name: aws.StringValue(source.Name),
+		Description: aws.StringValue(source.Description),
+		Region: region,
+		SourceRegion: sourceRegion,
+		SourceImageId: *source.ImageId,
+		Tags: tagMap(source.Tags),
+	}
+
+	name, err := renderTemplate(o.nameTemplate, data)
+	if err != nil { return nil, err }
+
+	description, err := renderTemplate(o.descriptionTemplate, data)
+	if err != nil { return nil, err }
+
+	input := &ec2.CopyImageInput{
+		SourceImageId: source.ImageId,
+		SourceRegion: &sourceRegion,
+		Name: &name,
+	}
+
+	if len(description) > 0 {
+		input.Description = &description
+	}
+
+	kmsKey, hasKey := o.kmsKeys[region]
+	if o.encrypt || hasKey {
+		input.Encrypted = aws.Bool(true)
+	}
+	if hasKey {
+		input.KmsKeyId = &kmsKey
+	}
+
+	tags := filterTags(source.Tags, o.tagInclude, o.tagExclude)
+	for key, value := range o.tags {
+		tags[key] = value
+	}
+	tags[sourceAmiTag] = *source.ImageId
+
+	if len(tags) > 0 {
+		input.TagSpecifications = []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeImage), Tags: ec2Tags(tags)},
+			{ResourceType: aws.String(ec2.ResourceTypeSnapshot), Tags: ec2Tags(tags)},
+		}
+	}
+
+	return input, nil
+}
+
+// copyTargets drops the source region from the regions to copy to.
+func copyTargets(sourceRegion string, regions []string) []string {
+	targets := []string{}
+	for _, region := range regions {
+		if region != sourceRegion {
+			targets = append(targets, region)
+		}
+	}
+	return targets
+}
+
+func copyAmiUi(sess *session.Session, amiId string, regions []string, opts copyOptions) (map[string]string, error) {
 	regionalAmis := map[string]string{}
 
 	blue := color.New(color.FgBlue)
 	boldBlue := color.New(color.FgBlue, color.Bold)
 
+	sourceRegion := *sess.Config.Region
+	regions = copyTargets(sourceRegion, regions)
+
 	if len(regions) > 0 {
 		boldBlue.Fprint(os.Stderr, "Copying AMI to other regions\n")
-		regionalAmis = copyAmi(sess, amiId, regions)
+
+		var err error
+		regionalAmis, err = copyAmi(sess, amiId, regions, opts)
+		if err != nil { return nil, err }
+
 		blue.Fprint(os.Stderr, "AMI IDs:\n")
 
 		for region, amiId := range regionalAmis {
@@ -63,35 +238,224 @@ func copyAmiUi(sess *session.Session, amiId string, regions []string) map[string
 		}
 	}
 
-	regionalAmis[*sess.Config.Region] = amiId
-	return regionalAmis
+	regionalAmis[sourceRegion] = amiId
+	return regionalAmis, nil
 }
 
-func copyAmi(sess *session.Session, amiId string, regions []string) map[string]string {
+// copyAmi copies amiId into each of regions, at most opts.concurrency at a
+// time. Regions that already hold a copy of amiId reuse it rather than
+// copying again, so retries are safe. The copies that succeeded are returned
+// even when others have failed.
+func copyAmi(sess *session.Session, amiId string, regions []string, opts copyOptions) (map[string]string, error) {
+	if err := opts.validate(regions); err != nil { return nil, err }
+
 	sourceRegion := *sess.Config.Region
-	name := amiName(sess, amiId)
+	source, err := describeImage(sess, amiId)
+	if err != nil { return nil, err }
+
 	amiIds := map[string]string{}
+	mut := sync.Mutex{}
 
-	for _, region := range regions {
-		sess = sess.Copy(&aws.Config{Region: aws.String(region)})
-		api := ec2.New(sess)
+	err = eachRegion(regions, opts.concurrency, func(region string) error {
+		regionSess := sess.Copy(&aws.Config{Region: aws.String(region)})
+		api := ec2.New(regionSess)
 
-		resp, err := api.CopyImage(&ec2.CopyImageInput{
-			SourceImageId: &amiId,
-			SourceRegion: &sourceRegion,
-			Name: &name,
-		})
-		if err != nil { panic(err) }
+		input, err := opts.copyInput(source, sourceRegion, region)
+		if err != nil { return err }
+
+		existing, err := findCopy(api, amiId, *input.Name)
+		if err != nil { return err }
 
+		if existing != nil {
+			if err := checkCopyEncryption(regionSess, existing, input); err != nil { return err }
+
+			regionProgress(color.New(color.FgBlue), region, "reusing existing copy %s (%s)", *existing.ImageId, *existing.State)
+
+			mut.Lock()
+			amiIds[region] = *existing.ImageId
+			mut.Unlock()
+			return nil
+		}
+
+		resp, err := api.CopyImage(input)
+		if err != nil { return err }
+
+		opts.journal.record(region, *resp.ImageId)
+
+		if input.KmsKeyId != nil {
+			regionProgress(color.New(color.FgBlue), region, "copying %s to %s as %s (encrypted with %s)", amiId, *resp.ImageId, *input.Name, *input.KmsKeyId)
+		} else if input.Encrypted != nil {
+			regionProgress(color.New(color.FgBlue), region, "copying %s to %s as %s (encrypted with default key)", amiId, *resp.ImageId, *input.Name)
+		} else {
+			regionProgress(color.New(color.FgBlue), region, "copying %s to %s as %s", amiId, *resp.ImageId, *input.Name)
+		}
+
+		mut.Lock()
 		amiIds[region] = *resp.ImageId
+		mut.Unlock()
+		return nil
+	})
+
+	return amiIds, err
+}
+
+// findCopies finds the copies of sourceAmiId (which lives in sess's region)
+// in each of regions.
+func findCopies(sess *session.Session, sourceAmiId string, regions []string, concurrency int) (map[string]string, error) {
+	sourceRegion := *sess.Config.Region
+	amiIds := map[string]string{}
+	mut := sync.Mutex{}
+
+	err := eachRegion(regions, concurrency, func(region string) error {
+		amiId := sourceAmiId
+
+		if region != sourceRegion {
+			api := ec2.New(sess.Copy(&aws.Config{Region: aws.String(region)}))
+
+			image, err := findCopy(api, sourceAmiId, "")
+			if err != nil { return err }
+			if image == nil { return fmt.Errorf("no copy of %s found", sourceAmiId) }
+
+			amiId = *image.ImageId
+		}
+
+		mut.Lock()
+		amiIds[region] = amiId
+		mut.Unlock()
+		return nil
+	})
+
+	return amiIds, err
+}
+
+// findCopy looks for an image in api's region that an earlier run already
+// copied from sourceAmiId, first by the source AMI tag we write and then by
+// name (if given). Images that have failed or been deregistered are ignored,
+// as are images with the same name whose source AMI tag says they were
+// copied from a different AMI.
+func findCopy(api *ec2.EC2, sourceAmiId, name string) (*ec2.Image, error) {
+	filterSets := [][]*ec2.Filter{
+		{{Name: aws.String("tag:" + sourceAmiTag), Values: aws.StringSlice([]string{sourceAmiId})}},
+	}
+	if len(name) > 0 {
+		filterSets = append(filterSets, []*ec2.Filter{{Name: aws.String("name"), Values: aws.StringSlice([]string{name})}})
+	}
+
+	for _, filters := range filterSets {
+		filters = append(filters, &ec2.Filter{
+			Name: aws.String("state"),
+			Values: aws.StringSlice([]string{ec2.ImageStatePending, ec2.ImageStateAvailable}),
+		})
+
+		resp, err := api.DescribeImages(&ec2.DescribeImagesInput{
+			Owners: aws.StringSlice([]string{"self"}),
+			Filters: filters,
+		})
+		if err != nil { return nil, err }
+
+		for _, image := range resp.Images {
+			if source, ok := tagMap(image.Tags)[sourceAmiTag]; ok && source != sourceAmiId {
+				continue
+			}
+			return image, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// checkCopyEncryption makes sure that a copy made by an earlier run is
+// encrypted the way input asks for, so that reusing it can't hand back an
+// unencrypted (or differently encrypted) image.
+func checkCopyEncryption(sess *session.Session, image *ec2.Image, input *ec2.CopyImageInput) error {
+	if !aws.BoolValue(input.Encrypted) { return nil }
+
+	api := ec2.New(sess)
+	amiId := *image.ImageId
+
+	snapshotIds, err := copySnapshotIds(api, amiId)
+	if err != nil { return err }
+	if len(snapshotIds) == 0 {
+		return fmt.Errorf("couldn't find the snapshots of existing copy %s to check its encryption", amiId)
+	}
+
+	resp, err := api.DescribeSnapshots(&ec2.DescribeSnapshotsInput{SnapshotIds: aws.StringSlice(snapshotIds)})
+	if err != nil { return err }
+
+	keyArn := ""
+	if input.KmsKeyId != nil {
+		keyResp, err := kms.New(sess).DescribeKey(&kms.DescribeKeyInput{KeyId: input.KmsKeyId})
+		if err != nil { return err }
+		keyArn = *keyResp.KeyMetadata.Arn
+	}
+
+	for _, snapshot := range resp.Snapshots {
+		if !aws.BoolValue(snapshot.Encrypted) {
+			return fmt.Errorf("existing copy %s has unencrypted snapshot %s; deregister it or use a different name template", amiId, *snapshot.SnapshotId)
+		}
+		if len(keyArn) > 0 && aws.StringValue(snapshot.KmsKeyId) != keyArn {
+			return fmt.Errorf("existing copy %s has snapshot %s encrypted with %s rather than %s; deregister it or use a different name template", amiId, *snapshot.SnapshotId, aws.StringValue(snapshot.KmsKeyId), keyArn)
+		}
+	}
+
+	return nil
+}
+
+// snapshotEncryption describes the EBS snapshots backing each (available) AMI
+// and whether they are encrypted.
+func snapshotEncryption(sess *session.Session, amiIds map[string]string) (map[string][]shared.SnapshotState, error) {
+	states := map[string][]shared.SnapshotState{}
+
+	for region, amiId := range amiIds {
+		api := ec2.New(sess.Copy(&aws.Config{Region: aws.String(region)}))
+
+		resp, err := api.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(amiId)}})
+		if err != nil { return nil, err }
+		if len(resp.Images) == 0 { return nil, fmt.Errorf("AMI %s not found in %s", amiId, region) }
+
+		regionStates := []shared.SnapshotState{}
+		for _, mapping := range resp.Images[0].BlockDeviceMappings {
+			if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil { continue }
+
+			regionStates = append(regionStates, shared.SnapshotState{
+				DeviceName: aws.StringValue(mapping.DeviceName),
+				SnapshotId: *mapping.Ebs.SnapshotId,
+				Encrypted: aws.BoolValue(mapping.Ebs.Encrypted),
+				KmsKeyId: aws.StringValue(mapping.Ebs.KmsKeyId),
+			})
+		}
+
+		states[region] = regionStates
+	}
+
+	return states, nil
+}
+
+func snapshotEncryptionUi(sess *session.Session, amiIds map[string]string) (map[string][]shared.SnapshotState, error) {
+	states, err := snapshotEncryption(sess, amiIds)
+	if err != nil { return nil, err }
+
+	blue := color.New(color.FgBlue)
+	blue.Fprint(os.Stderr, "Snapshot encryption:\n")
+
+	for region, regionStates := range states {
+		for _, state := range regionStates {
+			desc := "unencrypted"
+			if state.Encrypted {
+				desc = fmt.Sprintf("encrypted with %s", state.KmsKeyId)
+			}
+			blue.Fprintf(os.Stderr, "%s: %s (%s) %s\n", region, state.SnapshotId, state.DeviceName, desc)
+		}
 	}
 
-	return amiIds
+	return states, nil
 }
 
 func init() {
 	utilCmd.AddCommand(copyCmd)
-	copyCmd.PersistentFlags().StringSliceP("region", "r", []string{""}, "(optional, multiple) AWS regions to copy AMI to")
+	copyCmd.PersistentFlags().StringSliceP("region", "r", []string{""}, "(optional, multiple) AWS regions to copy AMI to, 'all' or a region group from the config file")
+	copyCmd.PersistentFlags().StringSlice("exclude-region", []string{""}, "(optional, multiple) AWS regions not to copy AMI to")
 	copyCmd.PersistentFlags().String("image-id", "", "Source AMI ID to copy")
 	copyCmd.PersistentFlags().BoolP("wait", "w", false, "Wait for copied images to be available")
+	addCopyFlags(copyCmd.PersistentFlags())
 }
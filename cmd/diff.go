@@ -0,0 +1,302 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/fatih/color"
+	"github.com/glassechidna/ami-automation/shared"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff EXEC_A EXEC_B",
+	Short: "Compare two SSM automation executions",
+	Long: `
+Compares two automation executions: their document versions and parameters,
+the steps they ran and, step by step, the status, duration, inputs, outputs
+and runCommand output of each. The first difference is highlighted, as it is
+usually where a build that used to work started to go wrong.
+
+Resource IDs and UUIDs in step inputs and outputs (instance IDs, command IDs,
+etc) change on every run, so they are ignored unless --exact is given. The
+execution's parameters are always compared exactly.
+
+Exits with a failure code if the executions differ.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		exact, _ := cmd.PersistentFlags().GetBool("exact")
+		slack, _ := cmd.PersistentFlags().GetDuration("duration-slack")
+
+		sess := awsSession()
+
+		a, err := getExecution(sess, args[0], false)
+		exitOnError(err)
+
+		b, err := getExecution(sess, args[1], false)
+		exitOnError(err)
+
+		differ := &executionDiffer{sess: sess, exact: exact, durationSlack: slack}
+		diffs, err := differ.diff(a, b)
+		exitOnError(err)
+
+		printDifferences(args[0], args[1], diffs)
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// difference is one thing that differs between two executions.
+type difference struct {
+	what string
+	a    string
+	b    string
+}
+
+type executionDiffer struct {
+	sess          *session.Session
+	exact         bool
+	durationSlack time.Duration
+	diffs         []difference
+}
+
+func (d *executionDiffer) compare(what, a, b string) {
+	if a != b {
+		d.diffs = append(d.diffs, difference{what: what, a: a, b: b})
+	}
+}
+
+func (d *executionDiffer) compareMaps(what string, a, b map[string]string) {
+	for _, key := range unionKeys(a, b) {
+		d.compare(fmt.Sprintf("%s %s", what, key), a[key], b[key])
+	}
+}
+
+// compareOutputs compares outputs, which (unless --exact) ignores the IDs of
+// the resources each run creates.
+func (d *executionDiffer) compareOutputs(what string, a, b map[string]string) {
+	for _, key := range unionKeys(a, b) {
+		valueA, valueB := a[key], b[key]
+		if !d.exact {
+			valueA, valueB = normaliseIds(valueA), normaliseIds(valueB)
+		}
+		d.compare(fmt.Sprintf("%s %s", what, key), valueA, valueB)
+	}
+}
+
+func (d *executionDiffer) diff(a, b *ssm.AutomationExecution) ([]difference, error) {
+	d.compare("document", aws.StringValue(a.DocumentName), aws.StringValue(b.DocumentName))
+	d.compare("document version", aws.StringValue(a.DocumentVersion), aws.StringValue(b.DocumentVersion))
+	d.compareMaps("parameter", joinedValues(a.Parameters), joinedValues(b.Parameters))
+	d.compare("steps", strings.Join(stepNames(a), ", "), strings.Join(stepNames(b), ", "))
+
+	stepsB := map[string]*ssm.StepExecution{}
+	for _, step := range b.StepExecutions {
+		stepsB[*step.StepName] = step
+	}
+
+	for _, stepA := range a.StepExecutions {
+		stepB, ok := stepsB[*stepA.StepName]
+		if !ok { continue }
+
+		if err := d.diffStep(stepA, stepB); err != nil { return nil, err }
+	}
+
+	d.compare("status", aws.StringValue(a.AutomationExecutionStatus), aws.StringValue(b.AutomationExecutionStatus))
+	d.compareOutputs("output", joinedValues(a.Outputs), joinedValues(b.Outputs))
+
+	return d.diffs, nil
+}
+
+func (d *executionDiffer) diffStep(a, b *ssm.StepExecution) error {
+	name := *a.StepName
+
+	d.compare(fmt.Sprintf("step %s status", name), aws.StringValue(a.StepStatus), aws.StringValue(b.StepStatus))
+
+	durationA, durationB := stepDuration(a), stepDuration(b)
+	if gap := durationA - durationB; gap > d.durationSlack || -gap > d.durationSlack {
+		d.diffs = append(d.diffs, difference{what: fmt.Sprintf("step %s duration", name), a: durationA.String(), b: durationB.String()})
+	}
+
+	// inputs are largely resolved from earlier steps' outputs, e.g. the
+	// instance a runCommand runs on, so they're compared like outputs
+	d.compareOutputs(fmt.Sprintf("step %s input", name), stepInputs(a), stepInputs(b))
+	d.compareOutputs(fmt.Sprintf("step %s output", name), joinedValues(a.Outputs), joinedValues(b.Outputs))
+	d.compare(fmt.Sprintf("step %s failure", name), aws.StringValue(a.FailureMessage), aws.StringValue(b.FailureMessage))
+
+	if aws.StringValue(a.Action) != "aws:runCommand" || aws.StringValue(b.Action) != "aws:runCommand" {
+		return nil
+	}
+
+	outputA, err := commandOutputs(d.sess, a)
+	if err != nil { return err }
+
+	outputB, err := commandOutputs(d.sess, b)
+	if err != nil { return err }
+
+	if !d.exact {
+		outputA, outputB = normaliseKeys(outputA), normaliseKeys(outputB)
+	}
+
+	for _, key := range unionKeys(outputA, outputB) {
+		d.compareLines(fmt.Sprintf("step %s command output %s", name, key), outputA[key], outputB[key])
+	}
+
+	return nil
+}
+
+// compareLines compares long outputs by their first differing line, rather
+// than in their entirety.
+func (d *executionDiffer) compareLines(what, a, b string) {
+	if !d.exact {
+		a, b = normaliseIds(a), normaliseIds(b)
+	}
+	if a == b { return }
+
+	linesA, linesB := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for idx := 0; idx < len(linesA) || idx < len(linesB); idx++ {
+		lineA, lineB := lineAt(linesA, idx), lineAt(linesB, idx)
+		if lineA != lineB {
+			d.diffs = append(d.diffs, difference{what: fmt.Sprintf("%s line %d", what, idx+1), a: lineA, b: lineB})
+			return
+		}
+	}
+}
+
+func lineAt(lines []string, idx int) string {
+	if idx < len(lines) {
+		return lines[idx]
+	}
+	return ""
+}
+
+var (
+	resourceIdPattern = regexp.MustCompile(`\b[a-z]+-[0-9a-f]{8}([0-9a-f]{9})?\b`)
+	uuidPattern       = regexp.MustCompile(`\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+)
+
+// normaliseIds replaces the IDs that are different on every run, e.g.
+// instance and command IDs, with placeholders.
+func normaliseIds(str string) string {
+	str = uuidPattern.ReplaceAllString(str, "<uuid>")
+	return resourceIdPattern.ReplaceAllString(str, "<id>")
+}
+
+func normaliseKeys(m map[string]string) map[string]string {
+	ret := map[string]string{}
+	for key, value := range m {
+		ret[normaliseIds(key)] = value
+	}
+	return ret
+}
+
+func commandOutputs(sess *session.Session, step *ssm.StepExecution) (map[string]string, error) {
+	outputs, err := shared.RunCommandOutputs(sess, step)
+	if err != nil { return nil, err }
+
+	ret := map[string]string{}
+	for _, output := range outputs {
+		ret[output.Key] = output.Body
+	}
+	return ret, nil
+}
+
+func stepNames(exec *ssm.AutomationExecution) []string {
+	names := []string{}
+	for _, step := range exec.StepExecutions {
+		names = append(names, *step.StepName)
+	}
+	return names
+}
+
+func stepDuration(step *ssm.StepExecution) time.Duration {
+	if step.ExecutionStartTime == nil || step.ExecutionEndTime == nil {
+		return 0
+	}
+	return step.ExecutionEndTime.Sub(*step.ExecutionStartTime).Round(time.Second)
+}
+
+func stepInputs(step *ssm.StepExecution) map[string]string {
+	ret := map[string]string{}
+	for name := range step.Inputs {
+		ret[name] = stepInputString(step, name)
+	}
+	return ret
+}
+
+func joinedValues(m map[string][]*string) map[string]string {
+	ret := map[string]string{}
+	for key, values := range m {
+		ret[key] = strings.Join(aws.StringValueSlice(values), ", ")
+	}
+	return ret
+}
+
+func unionKeys(a, b map[string]string) []string {
+	keys := []string{}
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func printDifferences(execA, execB string, diffs []difference) {
+	if len(diffs) == 0 {
+		color.New(color.FgGreen).Printf("%s and %s are the same\n", execA, execB)
+		return
+	}
+
+	fmt.Printf("--- %s\n+++ %s\n", execA, execB)
+
+	for idx, diff := range diffs {
+		heading := color.New(color.Bold)
+		if idx == 0 {
+			heading = color.New(color.Bold, color.FgYellow)
+			heading.Printf("%s (first difference)\n", diff.what)
+		} else {
+			heading.Printf("%s\n", diff.what)
+		}
+
+		color.New(color.FgRed).Printf("  - %s\n", indentLines(diff.a))
+		color.New(color.FgGreen).Printf("  + %s\n", indentLines(diff.b))
+	}
+}
+
+func indentLines(str string) string {
+	return strings.Replace(str, "\n", "\n    ", -1)
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+	diffCmd.PersistentFlags().Bool("exact", false, "Don't ignore resource IDs and UUIDs in step inputs and outputs that change on every run")
+	diffCmd.PersistentFlags().Duration("duration-slack", time.Minute, "Only report step durations that differ by more than this")
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// buildExecution is a typical successful build, launching instanceId and
+// running commandId on it.
+func buildExecution(sourceAmiId, instanceId, commandId, amiId string) *ssm.AutomationExecution {
+	step := func(name, action string, inputs map[string]string, outputs map[string]string) *ssm.StepExecution {
+		step := &ssm.StepExecution{
+			StepName:   aws.String(name),
+			Action:     aws.String(action),
+			StepStatus: aws.String("Success"),
+			Inputs:     map[string]*string{},
+			Outputs:    map[string][]*string{},
+		}
+		for key, value := range inputs {
+			step.Inputs[key] = aws.String(value)
+		}
+		for key, value := range outputs {
+			step.Outputs[key] = []*string{aws.String(value)}
+		}
+		return step
+	}
+
+	return &ssm.AutomationExecution{
+		DocumentName:              aws.String("build"),
+		DocumentVersion:           aws.String("3"),
+		AutomationExecutionStatus: aws.String("Success"),
+		Parameters:                map[string][]*string{"SourceAmiId": {aws.String(sourceAmiId)}},
+		Outputs:                   map[string][]*string{"createImage.ImageId": {aws.String(amiId)}},
+		StepExecutions: []*ssm.StepExecution{
+			step("launchInstance", "aws:runInstances", map[string]string{"ImageId": `"` + sourceAmiId + `"`}, map[string]string{"InstanceIds": instanceId}),
+			step("install", "aws:runCommand", map[string]string{"InstanceIds": `["` + instanceId + `"]`}, map[string]string{"CommandId": commandId}),
+			step("createImage", "aws:createImage", map[string]string{"InstanceId": `"` + instanceId + `"`}, map[string]string{"ImageId": amiId}),
+			step("createTags", "aws:createTags", map[string]string{"ResourceIds": `["` + amiId + `"]`}, nil),
+		},
+	}
+}
+
+func TestDiffIgnoresRunIds(t *testing.T) {
+	a := buildExecution("ami-0123456789abcdef0", "i-0123456789abcdef0", "0b5c2f3e-1d4a-4b6c-9e8f-7a6b5c4d3e2f", "ami-0aaaaaaaaaaaaaaaa")
+	b := buildExecution("ami-0123456789abcdef0", "i-0fedcba9876543210", "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d", "ami-0bbbbbbbbbbbbbbbb")
+
+	diffs, err := (&executionDiffer{}).diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) > 0 {
+		t.Errorf("expected no differences, got %+v", diffs)
+	}
+}
+
+func TestDiffComparesParametersExactly(t *testing.T) {
+	a := buildExecution("ami-0123456789abcdef0", "i-0123456789abcdef0", "0b5c2f3e-1d4a-4b6c-9e8f-7a6b5c4d3e2f", "ami-0aaaaaaaaaaaaaaaa")
+	b := buildExecution("ami-0fedcba9876543210", "i-0123456789abcdef0", "0b5c2f3e-1d4a-4b6c-9e8f-7a6b5c4d3e2f", "ami-0aaaaaaaaaaaaaaaa")
+
+	diffs, err := (&executionDiffer{}).diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) == 0 || diffs[0].what != "parameter SourceAmiId" {
+		t.Errorf("expected the first difference to be parameter SourceAmiId, got %+v", diffs)
+	}
+}
+
+func TestDiffExact(t *testing.T) {
+	a := buildExecution("ami-0123456789abcdef0", "i-0123456789abcdef0", "0b5c2f3e-1d4a-4b6c-9e8f-7a6b5c4d3e2f", "ami-0aaaaaaaaaaaaaaaa")
+	b := buildExecution("ami-0123456789abcdef0", "i-0fedcba9876543210", "0b5c2f3e-1d4a-4b6c-9e8f-7a6b5c4d3e2f", "ami-0aaaaaaaaaaaaaaaa")
+
+	diffs, err := (&executionDiffer{exact: true}).diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) == 0 || diffs[0].what != "step launchInstance output InstanceIds" {
+		t.Errorf("expected the first difference to be the launched instance, got %+v", diffs)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fatih/color"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// distributeOptions control copying shared AMIs into the target accounts
+// themselves, so that they don't depend on this account's image lifecycle.
+type distributeOptions struct {
+	enabled bool
+	// roleTemplate renders the ARN of the role to assume in each target
+	// account that has no profile, e.g.
+	// arn:aws:iam::{{.Account}}:role/ami-automation
+	roleTemplate *template.Template
+	// kmsKeys maps account IDs to the KMS key (ID, ARN or alias) to re-encrypt
+	// their copies with. Aliases resolve in each region.
+	kmsKeys map[string]string
+}
+
+func addDistributeFlags(flags *pflag.FlagSet) {
+	flags.Bool("distribute", false, "After sharing, copy AMIs into each target account too")
+	flags.String("distribute-role", "arn:aws:iam::{{.Account}}:role/ami-automation", "Template for the role ARN to assume in each target account")
+	flags.StringSlice("account-kms-key", []string{""}, "(optional, multiple) account=key KMS key to encrypt an account's copies with")
+}
+
+func newDistributeOptions() (distributeOptions, error) {
+	opts := distributeOptions{enabled: viper.GetBool("distribute")}
+
+	var err error
+
+	opts.roleTemplate, err = template.New("role").Parse(viper.GetString("distribute-role"))
+	if err != nil { return opts, err }
+
+	opts.kmsKeys, err = parseKeyValues(viper.GetStringSlice("account-kms-key"))
+	if err != nil { return opts, err }
+
+	return opts, nil
+}
+
+func (o distributeOptions) roleArn(account string) (string, error) {
+	buf := &bytes.Buffer{}
+	err := o.roleTemplate.Execute(buf, struct{ Account string }{account})
+	return buf.String(), err
+}
+
+// accountSession returns a session that acts in account, using the role from
+// its profile in the config file or else the distribute-role template.
+func (o distributeOptions) accountSession(sess *session.Session, account string) (*session.Session, error) {
+	roleArn, err := o.roleArn(account)
+	if err != nil { return nil, err }
+
+	return assumeRoleSession(sess, account, roleArn)
+}
+
+// distributeAmi copies the (already shared) AMI in each region into every
+// account, returning account -> region -> AMI ID. Copies made by an earlier
+// run are reused; new ones are recorded in journal.
+func distributeAmi(sess *session.Session, regionalAmis map[string]string, accounts []string, opts distributeOptions, concurrency int, journal *copyJournal) (map[string]map[string]string, error) {
+	regions := []string{}
+	for region := range regionalAmis {
+		regions = append(regions, region)
+	}
+
+	accountAmis := map[string]map[string]string{}
+
+	for _, account := range accounts {
+		accountSess, err := opts.accountSession(sess, account)
+		if err != nil { return accountAmis, err }
+
+		amiIds := map[string]string{}
+		mut := sync.Mutex{}
+
+		err = eachRegion(regions, concurrency, func(region string) error {
+			sourceAmiId := regionalAmis[region]
+
+			source, err := describeImage(sess.Copy(&aws.Config{Region: aws.String(region)}), sourceAmiId)
+			if err != nil { return err }
+
+			regionSess := accountSess.Copy(&aws.Config{Region: aws.String(region)})
+			amiId, reused, err := copyIntoAccount(regionSess, source, region, opts.kmsKeys[account])
+			if err != nil { return fmt.Errorf("account %s: %s", account, err.Error()) }
+
+			if reused {
+				regionProgress(color.New(color.FgBlue), region, "reusing %s in account %s", amiId, account)
+			} else {
+				journal.recordInAccount(accountSess, account, region, amiId)
+				regionProgress(color.New(color.FgBlue), region, "copying %s into account %s as %s", sourceAmiId, account, amiId)
+			}
+
+			mut.Lock()
+			amiIds[region] = amiId
+			mut.Unlock()
+			return nil
+		})
+
+		accountAmis[account] = amiIds
+		if err != nil { return accountAmis, err }
+	}
+
+	return accountAmis, nil
+}
+
+func copyIntoAccount(sess *session.Session, source *ec2.Image, region, kmsKey string) (string, bool, error) {
+	api := ec2.New(sess)
+
+	tags := filterTags(source.Tags, []string{"*"}, nil)
+	tags[sourceAmiTag] = *source.ImageId
+
+	input := &ec2.CopyImageInput{
+		SourceImageId: source.ImageId,
+		SourceRegion:  aws.String(region),
+		Name:          source.Name,
+		Description:   source.Description,
+		TagSpecifications: []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeImage), Tags: ec2Tags(tags)},
+			{ResourceType: aws.String(ec2.ResourceTypeSnapshot), Tags: ec2Tags(tags)},
+		},
+	}
+
+	if len(kmsKey) > 0 {
+		input.Encrypted = aws.Bool(true)
+		input.KmsKeyId = aws.String(kmsKey)
+	}
+
+	existing, err := findCopy(api, *source.ImageId, "")
+	if err != nil { return "", false, err }
+
+	if existing != nil {
+		if err := checkCopyEncryption(sess, existing, input); err != nil { return "", false, err }
+		return *existing.ImageId, true, nil
+	}
+
+	resp, err := api.CopyImage(input)
+	if err != nil { return "", false, err }
+
+	return *resp.ImageId, false, nil
+}
+
+func distributeAmiUi(sess *session.Session, regionalAmis map[string]string, accounts []string, opts distributeOptions, concurrency int, journal *copyJournal) (map[string]map[string]string, error) {
+	if !opts.enabled || len(accounts) == 0 { return nil, nil }
+
+	color.New(color.FgBlue, color.Bold).Fprint(os.Stderr, "Copying AMIs into target accounts\n")
+	return distributeAmi(sess, regionalAmis, accounts, opts, concurrency, journal)
+}
@@ -0,0 +1,36 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseKeyValues parses a list of key=value strings, e.g. from a repeated
+// flag, into a map.
+func parseKeyValues(raw []string) (map[string]string, error) {
+	ret := map[string]string{}
+
+	for _, pair := range nonEmpty(raw) {
+		split := strings.SplitN(pair, "=", 2)
+		if len(split) != 2 || len(split[0]) == 0 {
+			return nil, fmt.Errorf("expected key=value, got '%s'", pair)
+		}
+		ret[split[0]] = split[1]
+	}
+
+	return ret, nil
+}
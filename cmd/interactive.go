@@ -0,0 +1,189 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/fatih/color"
+	"github.com/glassechidna/ami-automation/shared"
+)
+
+// stepDriver starts the steps of an interactive execution one at a time, as
+// the user asks it to.
+type stepDriver struct {
+	sess   *session.Session
+	execId string
+	reader *bufio.Reader
+	// started is the step most recently signalled, which is given time to
+	// leave Pending before the user is asked about the next one
+	started string
+	skipped []string
+	stopped bool
+}
+
+// interactiveHandler returns the StatusReporter hook that drives an execution
+// started with Mode=Interactive.
+func interactiveHandler(sess *session.Session, execId string) shared.IdleHandler {
+	driver := &stepDriver{sess: sess, execId: execId, reader: bufio.NewReader(os.Stdin)}
+	return driver.next
+}
+
+// rerunHandler returns the StatusReporter hook that drives an interactive
+// execution without prompting: it skips straight to fromStep, then runs each
+// later step in turn. The skipped steps produce no outputs, so fromStep must
+// be one that retryPolicy.rerunFrom has checked doesn't depend on them.
+func rerunHandler(sess *session.Session, execId, fromStep string) shared.IdleHandler {
+	driver := &stepDriver{sess: sess, execId: execId}
+
+	return func(pending []*ssm.StepExecution) {
+		candidates := driver.candidates(pending)
+		if len(candidates) == 0 { return }
+
+		if len(driver.started) > 0 {
+			exitOnError(driver.signal(ssm.SignalTypeStartStep, *candidates[0].StepName))
+			return
+		}
+
+		for _, step := range candidates {
+			if *step.StepName == fromStep { break }
+			driver.skipped = append(driver.skipped, *step.StepName)
+		}
+		exitOnError(driver.signal(ssm.SignalTypeResume, fromStep))
+	}
+}
+
+// candidates returns the pending steps that haven't been skipped, or none if
+// the step last started hasn't got going yet.
+func (d *stepDriver) candidates(pending []*ssm.StepExecution) []*ssm.StepExecution {
+	candidates := []*ssm.StepExecution{}
+
+	for _, step := range pending {
+		if *step.StepName == d.started { return nil }
+		if !stringInSlice(*step.StepName, d.skipped) {
+			candidates = append(candidates, step)
+		}
+	}
+
+	return candidates
+}
+
+func (d *stepDriver) next(pending []*ssm.StepExecution) {
+	if d.stopped { return }
+
+	candidates := d.candidates(pending)
+	if len(candidates) == 0 { return }
+
+	step := candidates[0]
+	printUpcomingStep(step)
+
+	for {
+		fmt.Fprint(os.Stderr, "Run it, skip to a later step or stop the execution? [r/s/q]: ")
+		answer, err := d.reader.ReadString('\n')
+		if err != nil {
+			exitOnError(d.stop())
+			return
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "r", "run":
+			exitOnError(d.signal(ssm.SignalTypeStartStep, *step.StepName))
+			return
+		case "s", "skip":
+			target := d.chooseLaterStep(candidates[1:])
+			if len(target) == 0 { continue }
+
+			for _, skipped := range candidates {
+				if *skipped.StepName == target { break }
+				d.skipped = append(d.skipped, *skipped.StepName)
+			}
+			exitOnError(d.signal(ssm.SignalTypeResume, target))
+			return
+		case "q", "stop":
+			exitOnError(d.stop())
+			return
+		}
+	}
+}
+
+// chooseLaterStep asks which step to skip ahead to, defaulting to the one
+// after the upcoming step. It returns an empty string if there isn't one.
+func (d *stepDriver) chooseLaterStep(later []*ssm.StepExecution) string {
+	if len(later) == 0 {
+		color.New(color.FgYellow).Fprintln(os.Stderr, "There are no later steps to skip to")
+		return ""
+	}
+
+	names := []string{}
+	for _, step := range later {
+		names = append(names, *step.StepName)
+	}
+
+	for {
+		fmt.Fprintf(os.Stderr, "Skip to which step? [%s] (default %s): ", strings.Join(names, ", "), names[0])
+		answer, err := d.reader.ReadString('\n')
+		if err != nil { return "" }
+
+		answer = strings.TrimSpace(answer)
+		if len(answer) == 0 { return names[0] }
+		if stringInSlice(answer, names) { return answer }
+	}
+}
+
+func (d *stepDriver) signal(signal, stepName string) error {
+	_, err := ssm.New(d.sess).SendAutomationSignal(&ssm.SendAutomationSignalInput{
+		AutomationExecutionId: &d.execId,
+		SignalType:            &signal,
+		Payload:               map[string][]*string{"StepName": {aws.String(stepName)}},
+	})
+	if err != nil { return err }
+
+	d.started = stepName
+	color.New(color.FgBlue).Fprintf(os.Stderr, "Starting %s\n", stepName)
+	return nil
+}
+
+func (d *stepDriver) stop() error {
+	d.stopped = true
+	return stop(d.sess, d.execId, ssm.StopTypeCancel)
+}
+
+// printUpcomingStep shows the step that will run next and its inputs, as far
+// as SSM has resolved them.
+func printUpcomingStep(step *ssm.StepExecution) {
+	color.New(color.FgBlue, color.Bold).Fprintf(os.Stderr, "Next step: %s", *step.StepName)
+	color.New(color.FgBlue).Fprintf(os.Stderr, " (%s)\n", aws.StringValue(step.Action))
+
+	names := []string{}
+	for name := range step.Inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := stepInputString(step, name)
+		if strings.Contains(value, "\n") {
+			value = "\n    " + strings.Replace(value, "\n", "\n    ", -1)
+		}
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", name, value)
+	}
+}
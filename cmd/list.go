@@ -0,0 +1,271 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List SSM automation executions",
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.PersistentFlags()
+		name, _ := flags.GetString("name")
+		statuses, _ := flags.GetStringSlice("status")
+		after, _ := flags.GetString("started-after")
+		before, _ := flags.GetString("started-before")
+		rawTags, _ := flags.GetStringSlice("tag")
+		parent, _ := flags.GetString("parent")
+		max, _ := flags.GetInt("max")
+		output, _ := flags.GetString("output")
+
+		tags, err := parseKeyValues(rawTags)
+		exitOnError(err)
+
+		filter := executionFilter{
+			documentNamePrefix: name,
+			statuses: nonEmpty(statuses),
+			parentExecutionId: parent,
+			tags: tags,
+		}
+
+		filter.startedAfter, err = parseTimeFlag(after)
+		exitOnError(err)
+
+		filter.startedBefore, err = parseTimeFlag(before)
+		exitOnError(err)
+
+		executions, err := listExecutions(awsSession(), filter, max)
+		exitOnError(err)
+
+		switch output {
+		case "json":
+			bytes, _ := json.MarshalIndent(executions, "", "  ")
+			fmt.Println(string(bytes))
+		case "table":
+			printExecutionTable(executions)
+		default:
+			exitOnError(fmt.Errorf("unknown output format '%s', expected table or json", output))
+		}
+	},
+}
+
+type executionFilter struct {
+	documentNamePrefix string
+	statuses           []string
+	startedAfter       time.Time
+	startedBefore      time.Time
+	parentExecutionId  string
+	// tags must all be present on an execution with the given values
+	tags map[string]string
+}
+
+func (f executionFilter) apiFilters() []*ssm.AutomationExecutionFilter {
+	filters := []*ssm.AutomationExecutionFilter{}
+
+	add := func(key string, values ...string) {
+		filters = append(filters, &ssm.AutomationExecutionFilter{
+			Key:    aws.String(key),
+			Values: aws.StringSlice(values),
+		})
+	}
+
+	if len(f.documentNamePrefix) > 0 {
+		add(ssm.AutomationExecutionFilterKeyDocumentNamePrefix, f.documentNamePrefix)
+	}
+	if len(f.statuses) > 0 {
+		add(ssm.AutomationExecutionFilterKeyExecutionStatus, f.statuses...)
+	}
+	if !f.startedAfter.IsZero() {
+		add(ssm.AutomationExecutionFilterKeyStartTimeAfter, f.startedAfter.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+	if !f.startedBefore.IsZero() {
+		add(ssm.AutomationExecutionFilterKeyStartTimeBefore, f.startedBefore.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+	if len(f.parentExecutionId) > 0 {
+		add(ssm.AutomationExecutionFilterKeyParentExecutionId, f.parentExecutionId)
+	}
+	for key := range f.tags {
+		add(ssm.AutomationExecutionFilterKeyTagKey, key)
+	}
+
+	return filters
+}
+
+// parseTimeFlag accepts either an RFC3339 timestamp or a duration, meaning
+// that long ago. An empty string is the zero time.
+func parseTimeFlag(value string) (time.Time, error) {
+	if len(value) == 0 { return time.Time{}, nil }
+
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC3339 time or a duration, got '%s'", value)
+	}
+	return t, nil
+}
+
+// executionSummary is what list prints for each execution.
+type executionSummary struct {
+	ExecutionId       string
+	DocumentName      string
+	DocumentVersion   string
+	Status            string
+	Mode              string `json:",omitempty"`
+	ExecutedBy        string
+	StartTime         *time.Time `json:",omitempty"`
+	EndTime           *time.Time `json:",omitempty"`
+	ParentExecutionId string `json:",omitempty"`
+	FailureMessage    string `json:",omitempty"`
+}
+
+// listExecutions returns up to max executions (most recent first) matching
+// filter. Tag values are checked client-side, as the API only filters on
+// tag keys.
+func listExecutions(sess *session.Session, filter executionFilter, max int) ([]executionSummary, error) {
+	api := ssm.New(sess)
+	summaries := []executionSummary{}
+
+	input := &ssm.DescribeAutomationExecutionsInput{}
+	if filters := filter.apiFilters(); len(filters) > 0 {
+		input.Filters = filters
+	}
+
+	for {
+		resp, err := api.DescribeAutomationExecutions(input)
+		if err != nil { return nil, err }
+
+		for _, meta := range resp.AutomationExecutionMetadataList {
+			if len(filter.tags) > 0 {
+				matches, err := executionHasTags(api, *meta.AutomationExecutionId, filter.tags)
+				if err != nil { return nil, err }
+				if !matches { continue }
+			}
+
+			summaries = append(summaries, executionSummary{
+				ExecutionId:       aws.StringValue(meta.AutomationExecutionId),
+				DocumentName:      aws.StringValue(meta.DocumentName),
+				DocumentVersion:   aws.StringValue(meta.DocumentVersion),
+				Status:            aws.StringValue(meta.AutomationExecutionStatus),
+				Mode:              aws.StringValue(meta.Mode),
+				ExecutedBy:        aws.StringValue(meta.ExecutedBy),
+				StartTime:         meta.ExecutionStartTime,
+				EndTime:           meta.ExecutionEndTime,
+				ParentExecutionId: aws.StringValue(meta.ParentAutomationExecutionId),
+				FailureMessage:    aws.StringValue(meta.FailureMessage),
+			})
+
+			if max > 0 && len(summaries) >= max {
+				return summaries, nil
+			}
+		}
+
+		if resp.NextToken == nil { break }
+		input.NextToken = resp.NextToken
+	}
+
+	return summaries, nil
+}
+
+// runningExecution finds the most recent unfinished execution of the named
+// document that has all of tags, or returns nil if there isn't one.
+func runningExecution(sess *session.Session, name string, tags map[string]string) (*executionSummary, error) {
+	executions, err := listExecutions(sess, executionFilter{
+		documentNamePrefix: name,
+		statuses:           []string{ssm.AutomationExecutionStatusPending, ssm.AutomationExecutionStatusInProgress, ssm.AutomationExecutionStatusWaiting},
+		tags:               tags,
+	}, 0)
+	if err != nil { return nil, err }
+
+	for _, exec := range executions {
+		// the filter only matches on the name's prefix
+		if exec.DocumentName == name {
+			return &exec, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func executionHasTags(api *ssm.SSM, execId string, tags map[string]string) (bool, error) {
+	resp, err := api.ListTagsForResource(&ssm.ListTagsForResourceInput{
+		ResourceType: aws.String(ssm.ResourceTypeForTaggingAutomation),
+		ResourceId:   aws.String(execId),
+	})
+	if err != nil { return false, err }
+
+	actual := map[string]string{}
+	for _, tag := range resp.TagList {
+		actual[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	for key, value := range tags {
+		if actualValue, ok := actual[key]; !ok || actualValue != value {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func printExecutionTable(executions []executionSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EXECUTION ID\tDOCUMENT\tVERSION\tSTATUS\tSTARTED\tDURATION")
+
+	for _, exec := range executions {
+		started := ""
+		duration := ""
+
+		if exec.StartTime != nil {
+			started = exec.StartTime.Local().Format("2006-01-02 15:04:05")
+
+			end := time.Now()
+			if exec.EndTime != nil {
+				end = *exec.EndTime
+			}
+			duration = end.Sub(*exec.StartTime).Round(time.Second).String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", exec.ExecutionId, exec.DocumentName, exec.DocumentVersion, exec.Status, started, duration)
+	}
+
+	w.Flush()
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+
+	listCmd.PersistentFlags().String("name", "", "(optional) SSM Automation document name (prefix)")
+	listCmd.PersistentFlags().StringSlice("status", []string{""}, "(optional, multiple) execution statuses, e.g. InProgress, Success, Failed")
+	listCmd.PersistentFlags().String("started-after", "", "(optional) only executions started after this RFC3339 time or duration ago, e.g. 24h")
+	listCmd.PersistentFlags().String("started-before", "", "(optional) only executions started before this RFC3339 time or duration ago")
+	listCmd.PersistentFlags().StringSlice("tag", []string{""}, "(optional, multiple) key=value tags that executions must have")
+	listCmd.PersistentFlags().String("parent", "", "(optional) only child executions of this execution ID")
+	listCmd.PersistentFlags().Int("max", 50, "Maximum number of executions to list (0 for no limit)")
+	listCmd.PersistentFlags().StringP("output", "o", "table", "Output format: table or json")
+}
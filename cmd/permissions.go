@@ -0,0 +1,117 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/spf13/cobra"
+)
+
+var permissionsCmd = &cobra.Command{
+	Use:   "permissions",
+	Short: "Shows who can launch an AMI (and use its snapshots) in each region",
+	Run: func(cmd *cobra.Command, args []string) {
+		concurrency, _ := cmd.PersistentFlags().GetInt("concurrency")
+
+		sess := awsSession()
+		regionalAmis, err := regionalAmisFromFlags(cmd, sess)
+		exitOnError(err)
+
+		permissions, err := describePermissions(sess, regionalAmis, concurrency)
+		exitOnError(err)
+
+		printPermissions(permissions)
+	},
+}
+
+type imagePermissions struct {
+	region      string
+	amiId       string
+	launch      shareTargets
+	snapshotIds []string
+	snapshots   map[string]shareTargets
+}
+
+func describePermissions(sess *session.Session, regionalAmis map[string][]string, concurrency int) ([]imagePermissions, error) {
+	regions := []string{}
+	for region := range regionalAmis {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	results := map[string][]imagePermissions{}
+	mut := sync.Mutex{}
+
+	err := eachRegion(regions, concurrency, func(region string) error {
+		regionSess := sess.Copy(&aws.Config{Region: aws.String(region)})
+		api := ec2.New(regionSess)
+
+		for _, amiId := range regionalAmis[region] {
+			image, err := describeImage(regionSess, amiId)
+			if err != nil { return err }
+
+			perms := imagePermissions{
+				region:      region,
+				amiId:       amiId,
+				snapshotIds: imageSnapshotIds(image),
+				snapshots:   map[string]shareTargets{},
+			}
+
+			perms.launch, err = currentLaunchTargets(api, amiId)
+			if err != nil { return err }
+
+			for _, snapshotId := range perms.snapshotIds {
+				perms.snapshots[snapshotId], err = currentSnapshotTargets(api, snapshotId)
+				if err != nil { return err }
+			}
+
+			mut.Lock()
+			results[region] = append(results[region], perms)
+			mut.Unlock()
+		}
+
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	ordered := []imagePermissions{}
+	for _, region := range regions {
+		ordered = append(ordered, results[region]...)
+	}
+
+	return ordered, nil
+}
+
+func printPermissions(permissions []imagePermissions) {
+	for _, perms := range permissions {
+		fmt.Printf("%s %s\n", perms.region, perms.amiId)
+		fmt.Printf("  launch: %s\n", perms.launch)
+
+		for _, snapshotId := range perms.snapshotIds {
+			fmt.Printf("  %s: %s\n", snapshotId, perms.snapshots[snapshotId])
+		}
+	}
+}
+
+func init() {
+	utilCmd.AddCommand(permissionsCmd)
+	addRegionalAmiFlags(permissionsCmd.PersistentFlags())
+}
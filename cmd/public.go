@@ -0,0 +1,90 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/spf13/viper"
+)
+
+// privatePolicy describes images that must never be made public. It is read
+// from the config file, e.g.
+//
+//   private-policy:
+//     names: ["*-internal-*"]
+//     tags:
+//       Classification: confidential
+//
+// Names and tag values are shell-style patterns.
+type privatePolicy struct {
+	names []string
+	tags  map[string]string
+}
+
+func newPrivatePolicy() privatePolicy {
+	return privatePolicy{
+		names: nonEmpty(viper.GetStringSlice("private-policy.names")),
+		tags:  viper.GetStringMapString("private-policy.tags"),
+	}
+}
+
+// match returns why the image is considered private, or an empty string if
+// it isn't.
+func (p privatePolicy) match(image *ec2.Image) string {
+	name := aws.StringValue(image.Name)
+	if matchesAny(p.names, name) {
+		return fmt.Sprintf("its name %s matches the private-policy names", name)
+	}
+
+	tags := tagMap(image.Tags)
+	for key, pattern := range p.tags {
+		if value, ok := tags[key]; ok && matchesAny([]string{pattern}, value) {
+			return fmt.Sprintf("its tag %s=%s matches the private-policy tags", key, value)
+		}
+	}
+
+	return ""
+}
+
+func (t shareTargets) public() bool {
+	return stringInSlice(ec2.PermissionGroupAll, t.groups)
+}
+
+// checkPublic rejects making an image public unless it was explicitly
+// allowed, the account doesn't block public AMI sharing and the image isn't
+// covered by the private policy.
+func checkPublic(api *ec2.EC2, image *ec2.Image, opts shareOptions) error {
+	if !opts.targets.public() { return nil }
+
+	if !opts.allowPublic {
+		return fmt.Errorf("refusing to make %s public without --allow-public", *image.ImageId)
+	}
+
+	if reason := newPrivatePolicy().match(image); len(reason) > 0 {
+		return fmt.Errorf("refusing to make %s public: %s", *image.ImageId, reason)
+	}
+
+	resp, err := api.GetImageBlockPublicAccessState(&ec2.GetImageBlockPublicAccessStateInput{})
+	if err != nil { return err }
+
+	if aws.StringValue(resp.ImageBlockPublicAccessState) == ec2.ImageBlockPublicAccessEnabledStateBlockNewSharing {
+		return fmt.Errorf("can't make %s public: block public access for AMIs is enabled in this account and region", *image.ImageId)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fatih/color"
+	"github.com/spf13/viper"
+)
+
+// allRegions is the --region alias for every region enabled in the account.
+const allRegions = "all"
+
+// resolveRegions expands the region aliases in regions - "all" and the names
+// of groups defined under region-groups in the config file, e.g.
+//
+//   region-groups:
+//     eu: [eu-west-1, eu-central-1]
+//
+// - into region names, then removes any that are in excludes.
+func resolveRegions(sess *session.Session, regions, excludes []string) ([]string, error) {
+	groups := viper.GetStringMapStringSlice("region-groups")
+	resolved := []string{}
+
+	for _, region := range nonEmpty(regions) {
+		expanded := []string{region}
+
+		if region == allRegions {
+			var err error
+			expanded, err = enabledRegions(sess)
+			if err != nil { return nil, err }
+		} else if group, ok := groups[region]; ok {
+			expanded = group
+		}
+
+		for _, name := range expanded {
+			if !stringInSlice(name, resolved) && !stringInSlice(name, excludes) {
+				resolved = append(resolved, name)
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// usesRegionAlias reports whether any of regions is "all" or a region group
+// rather than a region name.
+func usesRegionAlias(regions []string) bool {
+	groups := viper.GetStringMapStringSlice("region-groups")
+
+	for _, region := range regions {
+		if _, ok := groups[region]; ok || region == allRegions {
+			return true
+		}
+	}
+	return false
+}
+
+// enabledRegions lists the regions that the account can use, i.e. those that
+// either don't need opting in to or have been opted in to.
+func enabledRegions(sess *session.Session) ([]string, error) {
+	api := ec2.New(sess)
+
+	resp, err := api.DescribeRegions(&ec2.DescribeRegionsInput{
+		AllRegions: aws.Bool(true),
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("opt-in-status"),
+			Values: aws.StringSlice([]string{"opt-in-not-required", "opted-in"}),
+		}},
+	})
+	if err != nil { return nil, err }
+
+	regions := []string{}
+	for _, region := range resp.Regions {
+		regions = append(regions, *region.RegionName)
+	}
+	sort.Strings(regions)
+
+	return regions, nil
+}
+
+// regionErrors collects the failures of an operation that was run against
+// several regions, so that one failing region doesn't hide the others.
+type regionErrors map[string]error
+
+func (e regionErrors) Error() string {
+	regions := []string{}
+	for region := range e {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	lines := []string{}
+	for _, region := range regions {
+		lines = append(lines, fmt.Sprintf("  %s: %s", region, e[region]))
+	}
+
+	return fmt.Sprintf("%d region(s) failed:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// eachRegion calls fn for every region, with no more than concurrency calls
+// in flight at once. A concurrency of zero or less means no limit.
+func eachRegion(regions []string, concurrency int, fn func(region string) error) error {
+	if concurrency < 1 {
+		concurrency = len(regions) + 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	errs := regionErrors{}
+	mut := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := fn(region); err != nil {
+				mut.Lock()
+				errs[region] = err
+				mut.Unlock()
+			}
+		}(region)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// limiter bounds how many goroutines can be doing something at once, e.g.
+// calling an API. A nil limiter doesn't limit anything.
+type limiter chan struct{}
+
+// newLimiter returns a limiter allowing limit at once, or no limit if it is
+// zero or less.
+func newLimiter(limit int) limiter {
+	if limit < 1 { return nil }
+	return make(limiter, limit)
+}
+
+func (l limiter) do(fn func() error) error {
+	if l == nil { return fn() }
+
+	l <- struct{}{}
+	defer func() { <-l }()
+	return fn()
+}
+
+var progressMut sync.Mutex
+
+// regionProgress prints a single progress line for a region to stderr. It is
+// safe to call from concurrently running per-region goroutines.
+func regionProgress(c *color.Color, region, format string, a ...interface{}) {
+	progressMut.Lock()
+	defer progressMut.Unlock()
+
+	c.Fprintf(os.Stderr, "%s: %s\n", region, fmt.Sprintf(format, a...))
+}
+
+// nonEmpty strips the empty strings that unset slice flags default to.
+func nonEmpty(strs []string) []string {
+	ret := []string{}
+	for _, str := range strs {
+		if len(str) > 0 {
+			ret = append(ret, str)
+		}
+	}
+	return ret
+}
+
+func stringInSlice(str string, list []string) bool {
+	for _, value := range list {
+		if value == str {
+			return true
+		}
+	}
+	return false
+}
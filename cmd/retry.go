@@ -0,0 +1,237 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/spf13/viper"
+	"github.com/fatih/color"
+)
+
+// retryPolicy decides which failed executions --retries restarts. It is read
+// from retry-policy in the config file, e.g.
+//
+//   retry-policy:
+//     steps: [launchInstance, install*]
+//     failure-types: [Invocation]
+//     failure-messages: [InsufficientInstanceCapacity, "Cannot retrieve repository metadata"]
+//     rerun-from: [launchInstance]
+//
+// A failure is retryable if the failed step matches one of steps (or steps is
+// empty) and either failure-types or failure-messages matches (or both are
+// empty).
+//
+// Steps matching rerun-from can be restarted at: rather than from the
+// beginning, the document is re-run in interactive mode, skipping straight to
+// the failed step. The skipped steps don't run, so their outputs don't exist
+// in the new execution - a step is only restarted at if neither it, nor any
+// step after it, nor the document's outputs refer to the outputs of an earlier
+// step. This is checked against the document before each retry; when it
+// doesn't hold, the retry starts from the beginning instead.
+type retryPolicy struct {
+	Steps           []string `mapstructure:"steps"`
+	FailureTypes    []string `mapstructure:"failure-types"`
+	FailureMessages []string `mapstructure:"failure-messages"`
+	RerunFrom       []string `mapstructure:"rerun-from"`
+}
+
+func newRetryPolicy() retryPolicy {
+	policy := retryPolicy{}
+	viper.UnmarshalKey("retry-policy", &policy)
+	return policy
+}
+
+// executionFailure is why an execution failed, as far as we can tell.
+type executionFailure struct {
+	status      string
+	step        string
+	action      string
+	failureType string
+	message     string
+	// documentVersion is the version of the document that failed, which is
+	// what rerunFrom checks step dependencies against
+	documentName    string
+	documentVersion string
+}
+
+func (f executionFailure) String() string {
+	if len(f.step) == 0 {
+		return fmt.Sprintf("%s: %s", f.status, f.message)
+	}
+	return fmt.Sprintf("%s failed (%s): %s", f.step, f.failureType, f.message)
+}
+
+// failedStep finds the step that failed the execution.
+func failedStep(sess *session.Session, execId string) (executionFailure, error) {
+	resp, err := ssm.New(sess).GetAutomationExecution(&ssm.GetAutomationExecutionInput{AutomationExecutionId: &execId})
+	if err != nil { return executionFailure{}, err }
+
+	exec := resp.AutomationExecution
+	failure := executionFailure{
+		status:          aws.StringValue(exec.AutomationExecutionStatus),
+		message:         aws.StringValue(exec.FailureMessage),
+		documentName:    aws.StringValue(exec.DocumentName),
+		documentVersion: aws.StringValue(exec.DocumentVersion),
+	}
+
+	for _, step := range exec.StepExecutions {
+		switch aws.StringValue(step.StepStatus) {
+		case ssm.AutomationExecutionStatusFailed, ssm.AutomationExecutionStatusTimedOut:
+			failure.step = *step.StepName
+			failure.action = aws.StringValue(step.Action)
+			failure.message = aws.StringValue(step.FailureMessage)
+			if step.FailureDetails != nil {
+				failure.failureType = aws.StringValue(step.FailureDetails.FailureType)
+			}
+			return failure, nil
+		}
+	}
+
+	return failure, nil
+}
+
+// retryable reports whether the policy allows retrying after failure. Only
+// executions that failed or timed out are retried: ones that were cancelled
+// (or rejected at an aws:approve step) were stopped on purpose.
+func (p retryPolicy) retryable(failure executionFailure) bool {
+	if failure.status != ssm.AutomationExecutionStatusFailed && failure.status != ssm.AutomationExecutionStatusTimedOut {
+		return false
+	}
+
+	if failure.action == "aws:approve" {
+		return false
+	}
+
+	if len(p.Steps) > 0 && !matchesAny(p.Steps, failure.step) {
+		return false
+	}
+
+	if len(p.FailureTypes) == 0 && len(p.FailureMessages) == 0 {
+		return true
+	}
+
+	if stringInSlice(failure.failureType, p.FailureTypes) {
+		return true
+	}
+
+	for _, message := range p.FailureMessages {
+		if strings.Contains(failure.message, message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rerunFrom returns the step that a retry can start at, or an empty string if
+// it has to start from the beginning.
+func (p retryPolicy) rerunFrom(sess *session.Session, failure executionFailure) (string, error) {
+	if len(failure.step) == 0 || !matchesAny(p.RerunFrom, failure.step) {
+		return "", nil
+	}
+
+	dependency, err := skippedStepDependency(sess, failure)
+	if err != nil { return "", err }
+
+	if len(dependency) > 0 {
+		color.New(color.FgYellow).Fprintf(os.Stderr, "Can't rerun from %s, as %s\n", failure.step, dependency)
+		return "", nil
+	}
+
+	return failure.step, nil
+}
+
+// stepReferencePattern matches references to step outputs in a document's
+// steps, e.g. "{{ launchInstance.InstanceIds }}".
+var stepReferencePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_-]+)\.`)
+
+// skippedStepDependency fetches the failed document to check whether
+// rerunning it from the failed step would need the outputs of a step before
+// it. See documentStepDependency.
+func skippedStepDependency(sess *session.Session, failure executionFailure) (string, error) {
+	input := &ssm.GetDocumentInput{
+		Name:           aws.String(failure.documentName),
+		DocumentFormat: aws.String(ssm.DocumentFormatJson),
+	}
+	if len(failure.documentVersion) > 0 {
+		input.DocumentVersion = aws.String(failure.documentVersion)
+	}
+
+	resp, err := ssm.New(sess).GetDocument(input)
+	if err != nil { return "", err }
+
+	return documentStepDependency(aws.StringValue(resp.Content), failure.step), nil
+}
+
+// documentStepDependency checks whether running the (JSON) document content
+// from failedStep onwards would need the outputs of a step before it,
+// describing the first such dependency, or why it can't tell, or returning an
+// empty string if there are none.
+func documentStepDependency(content, failedStep string) string {
+	doc := struct {
+		MainSteps []json.RawMessage `json:"mainSteps"`
+		Outputs   []string          `json:"outputs"`
+	}{}
+	if err := json.Unmarshal([]byte(content), &doc); err != nil {
+		return fmt.Sprintf("the document couldn't be parsed: %s", err.Error())
+	}
+
+	skipped := []string{}
+	reached := false
+
+	for _, raw := range doc.MainSteps {
+		step := struct {
+			Name string `json:"name"`
+		}{}
+		if err := json.Unmarshal(raw, &step); err != nil {
+			return fmt.Sprintf("the document couldn't be parsed: %s", err.Error())
+		}
+
+		if step.Name == failedStep {
+			reached = true
+		}
+
+		if !reached {
+			skipped = append(skipped, step.Name)
+			continue
+		}
+
+		for _, match := range stepReferencePattern.FindAllStringSubmatch(string(raw), -1) {
+			if stringInSlice(match[1], skipped) {
+				return fmt.Sprintf("step %s uses the outputs of %s, which would be skipped", step.Name, match[1])
+			}
+		}
+	}
+
+	if !reached {
+		return "it isn't in the document"
+	}
+
+	for _, output := range doc.Outputs {
+		if stepName := strings.SplitN(output, ".", 2)[0]; stringInSlice(stepName, skipped) {
+			return fmt.Sprintf("document output %s comes from %s, which would be skipped", output, stepName)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	failed := executionFailure{
+		status:      "Failed",
+		step:        "launchInstance",
+		action:      "aws:runInstances",
+		failureType: "Invocation",
+		message:     "InsufficientInstanceCapacity: no capacity",
+	}
+
+	with := func(change func(f *executionFailure)) executionFailure {
+		f := failed
+		change(&f)
+		return f
+	}
+
+	tests := []struct {
+		name     string
+		policy   retryPolicy
+		failure  executionFailure
+		expected bool
+	}{
+		{"no policy", retryPolicy{}, failed, true},
+		{"timed out", retryPolicy{}, with(func(f *executionFailure) { f.status = "TimedOut" }), true},
+		{"cancelled", retryPolicy{}, with(func(f *executionFailure) { f.status = "Cancelled"; f.step = "" }), false},
+		{"still running", retryPolicy{}, with(func(f *executionFailure) { f.status = "InProgress" }), false},
+		{"rejected approval", retryPolicy{}, with(func(f *executionFailure) { f.step = "approve"; f.action = "aws:approve" }), false},
+		{"step matches", retryPolicy{Steps: []string{"launch*"}}, failed, true},
+		{"step doesn't match", retryPolicy{Steps: []string{"install*"}}, failed, false},
+		{"failure type matches", retryPolicy{FailureTypes: []string{"Invocation"}}, failed, true},
+		{"failure type doesn't match", retryPolicy{FailureTypes: []string{"Verification"}}, failed, false},
+		{"message matches", retryPolicy{FailureMessages: []string{"InsufficientInstanceCapacity"}}, failed, true},
+		{"message doesn't match", retryPolicy{FailureMessages: []string{"yum"}}, failed, false},
+		{"either matches", retryPolicy{FailureTypes: []string{"Verification"}, FailureMessages: []string{"no capacity"}}, failed, true},
+		{"step and message must both match", retryPolicy{Steps: []string{"install*"}, FailureMessages: []string{"no capacity"}}, failed, false},
+	}
+
+	for _, test := range tests {
+		if actual := test.policy.retryable(test.failure); actual != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+const retryDocument = `{
+  "schemaVersion": "0.3",
+  "parameters": {"InstanceType": {"type": "String"}},
+  "mainSteps": [
+    {"name": "lookupAmi", "action": "aws:executeAwsApi", "outputs": [{"Name": "ImageId", "Selector": "$.Images[0].ImageId"}]},
+    {"name": "launchInstance", "action": "aws:runInstances", "inputs": {"ImageId": "{{ lookupAmi.ImageId }}", "InstanceType": "{{ InstanceType }}"}},
+    {"name": "install", "action": "aws:runCommand", "inputs": {"InstanceIds": ["{{launchInstance.InstanceIds}}"]}},
+    {"name": "createImage", "action": "aws:createImage", "inputs": {"InstanceId": "{{ launchInstance.InstanceIds }}", "ImageName": "build-{{ global:DATE_TIME }}-{{automation:EXECUTION_ID}}"}}
+  ],
+  "outputs": [%s]
+}`
+
+func TestDocumentStepDependency(t *testing.T) {
+	document := func(outputs string) string {
+		return strings.Replace(retryDocument, "%s", outputs, 1)
+	}
+
+	tests := []struct {
+		name       string
+		content    string
+		failedStep string
+		// expected is a substring of the dependency, or empty for none
+		expected string
+	}{
+		{"first step", document(`"createImage.ImageId"`), "lookupAmi", ""},
+		{"later step uses skipped output", document(`"createImage.ImageId"`), "install", "step install uses the outputs of launchInstance"},
+		{"failed step uses skipped output", document(`"createImage.ImageId"`), "launchInstance", "step launchInstance uses the outputs of lookupAmi"},
+		{"globals and parameters don't count", strings.Replace(document(`"createImage.ImageId"`), "{{ lookupAmi.ImageId }}", "ami-0123456789abcdef0", 1), "launchInstance", ""},
+		{"document output from skipped step", strings.Replace(document(`"lookupAmi.ImageId"`), "{{ lookupAmi.ImageId }}", "ami-0123456789abcdef0", 1), "launchInstance", "document output lookupAmi.ImageId comes from lookupAmi"},
+		{"step not in document", document(``), "missing", "isn't in the document"},
+		{"unparseable document", "mainSteps: []", "install", "couldn't be parsed"},
+	}
+
+	for _, test := range tests {
+		actual := documentStepDependency(test.content, test.failedStep)
+
+		if len(test.expected) == 0 && len(actual) > 0 {
+			t.Errorf("%s: expected no dependency, got %s", test.name, actual)
+		}
+		if len(test.expected) > 0 && !strings.Contains(actual, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+}
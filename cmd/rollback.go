@@ -0,0 +1,185 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fatih/color"
+)
+
+// copyJournal records the images that a run created (as opposed to reused)
+// so that they can be cleaned up if a later step fails.
+type copyJournal struct {
+	mut sync.Mutex
+	// created is keyed by a label of the region (and account, for copies
+	// made in other accounts)
+	created map[string]createdAmi
+}
+
+type createdAmi struct {
+	region string
+	amiId  string
+	// sess acts in the account the copy was made in, or is nil for this one
+	sess *session.Session
+}
+
+func newCopyJournal() *copyJournal {
+	return &copyJournal{created: map[string]createdAmi{}}
+}
+
+func (j *copyJournal) record(region, amiId string) {
+	j.add(region, createdAmi{region: region, amiId: amiId})
+}
+
+// recordInAccount records a copy made in another account, with the session
+// that can clean it up.
+func (j *copyJournal) recordInAccount(accountSess *session.Session, account, region, amiId string) {
+	label := fmt.Sprintf("%s (account %s)", region, account)
+	j.add(label, createdAmi{region: region, amiId: amiId, sess: accountSess})
+}
+
+func (j *copyJournal) add(label string, ami createdAmi) {
+	if j == nil { return }
+
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	j.created[label] = ami
+}
+
+// rollback deregisters every image in the journal and deletes its snapshots.
+// It carries on past failures so that as much as possible is cleaned up.
+func (j *copyJournal) rollback(sess *session.Session, concurrency int) error {
+	labels := []string{}
+	for label := range j.created {
+		labels = append(labels, label)
+	}
+
+	return eachRegion(labels, concurrency, func(label string) error {
+		created := j.created[label]
+		amiId := created.amiId
+
+		accountSess := sess
+		if created.sess != nil {
+			accountSess = created.sess
+		}
+		api := ec2.New(accountSess.Copy(&aws.Config{Region: aws.String(created.region)}))
+
+		snapshotIds, err := copySnapshotIds(api, amiId)
+		if err != nil { return err }
+
+		_, err = api.DeregisterImage(&ec2.DeregisterImageInput{ImageId: &amiId})
+		if err != nil { return err }
+
+		deleted := []string{}
+		failed := []string{}
+
+		for _, snapshotId := range snapshotIds {
+			_, err := api.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotId)})
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s (%s)", snapshotId, err.Error()))
+			} else {
+				deleted = append(deleted, snapshotId)
+			}
+		}
+
+		regionProgress(color.New(color.FgYellow), label, "deregistered %s, deleted snapshots [%s]", amiId, strings.Join(deleted, ", "))
+
+		if len(failed) > 0 {
+			return fmt.Errorf("deregistered %s but couldn't delete snapshots: %s", amiId, strings.Join(failed, ", "))
+		}
+		return nil
+	})
+}
+
+// copySnapshotIds finds the snapshots backing a copied image. Copies that are
+// still pending don't list their snapshots yet, so they are also found by the
+// description EC2 gives snapshots that it creates for a CopyImage.
+func copySnapshotIds(api *ec2.EC2, amiId string) ([]string, error) {
+	ids := []string{}
+
+	resp, err := api.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{&amiId}})
+	if err != nil { return nil, err }
+
+	for _, image := range resp.Images {
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+				ids = append(ids, *mapping.Ebs.SnapshotId)
+			}
+		}
+	}
+
+	snapshots, err := copyingSnapshots(api, amiId)
+	if err != nil { return nil, err }
+
+	for _, snapshot := range snapshots {
+		if !stringInSlice(*snapshot.SnapshotId, ids) {
+			ids = append(ids, *snapshot.SnapshotId)
+		}
+	}
+
+	return ids, nil
+}
+
+// copyingSnapshots finds the snapshots of a copied image by the description
+// EC2 gives them, which works while the image is still pending.
+func copyingSnapshots(api *ec2.EC2, amiId string) ([]*ec2.Snapshot, error) {
+	resp, err := api.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		OwnerIds: aws.StringSlice([]string{"self"}),
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("description"),
+			Values: aws.StringSlice([]string{fmt.Sprintf("*DestinationAmi %s *", amiId)}),
+		}},
+	})
+	if err != nil { return nil, err }
+
+	return resp.Snapshots, nil
+}
+
+// rollbackOnError exits the process if err is non-nil, first cleaning up the
+// images created so far unless the user asked to keep them.
+func rollbackOnError(sess *session.Session, opts copyOptions, err error) {
+	if err == nil { return }
+
+	color.New(color.FgRed).Fprintln(os.Stderr, err.Error())
+
+	if len(opts.journal.created) == 0 {
+		os.Exit(1)
+	}
+
+	if opts.keepPartial {
+		color.New(color.FgYellow).Fprintln(os.Stderr, "Keeping partially copied AMIs (--keep-partial):")
+		for label, created := range opts.journal.created {
+			color.New(color.FgYellow).Fprintf(os.Stderr, "%s: %s\n", label, created.amiId)
+		}
+		os.Exit(1)
+	}
+
+	color.New(color.FgYellow, color.Bold).Fprintln(os.Stderr, "Rolling back AMIs created by this run")
+	rollbackErr := opts.journal.rollback(sess, opts.concurrency)
+	if rollbackErr != nil {
+		color.New(color.FgRed).Fprintf(os.Stderr, "Rollback incomplete, clean up manually: %s\n", rollbackErr.Error())
+	} else {
+		color.New(color.FgYellow).Fprintf(os.Stderr, "Rolled back %d AMI(s)\n", len(opts.journal.created))
+	}
+
+	os.Exit(1)
+}
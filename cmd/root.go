@@ -20,6 +20,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/fatih/color"
 )
 
 var cfgFile string
@@ -46,6 +47,14 @@ func Execute() {
 	}
 }
 
+// exitOnError prints err to stderr and exits with a failure code. It does
+// nothing when err is nil.
+func exitOnError(err error) {
+	if err == nil { return }
+	color.New(color.FgRed).Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 }
@@ -62,6 +71,7 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		// stderr, as stdout is for results, e.g. JSON piped into 'util wait'
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
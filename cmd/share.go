@@ -21,66 +21,255 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"os"
 	"github.com/fatih/color"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"time"
 )
 
 var shareCmd = &cobra.Command{
 	Use:   "share",
 	Short: "A brief description of your command",
 	Run: func(cmd *cobra.Command, args []string) {
-		amiId, _ := cmd.PersistentFlags().GetString("image-id")
-		accounts, _ := cmd.PersistentFlags().GetStringSlice("account")
+		viper.BindPFlags(cmd.PersistentFlags())
+
+		amiId := viper.GetString("image-id")
+		opts := newShareOptions()
+		exitOnError(opts.validate())
 
 		sess := awsSession()
 		region := *sess.Config.Region
 		regionalAmis := map[string]string{}
 		regionalAmis[region] = amiId
 
-		shareAmiUi(sess, regionalAmis, accounts)
+		exitOnError(shareAmiUi(sess, regionalAmis, opts))
+
+		distOpts, err := newDistributeOptions()
+		exitOnError(err)
+
+		journal := newCopyJournal()
+		_, err = distributeAmiUi(sess, regionalAmis, opts.targets.accounts, distOpts, opts.concurrency, journal)
+		rollbackOnError(sess, copyOptions{journal: journal, keepPartial: viper.GetBool("keep-partial"), concurrency: opts.concurrency}, err)
 	},
 }
 
-func shareAmiUi(sess *session.Session, regionalAmis map[string]string, accounts []string) {
-	blue := color.New(color.FgBlue)
+type shareOptions struct {
+	targets shareTargets
+	// exact makes targets the complete list of principals that the images are
+	// shared with, removing any others
+	exact bool
+	// allowPublic permits sharing with the "all" group, i.e. everyone
+	allowPublic bool
+	// concurrency is the maximum number of regions shared in at once
+	concurrency int
+	// waitTimeout is how long to wait for each AMI to be available to share
+	waitTimeout time.Duration
+}
+
+// addShareFlags defines the flags shared by every command that shares AMIs.
+func addShareFlags(flags *pflag.FlagSet) {
+	addShareTargetFlags(flags, "share AMI with")
+	flags.Bool("exact", false, "Also remove launch (and snapshot) permissions from anyone not listed")
+	flags.Bool("allow-public", false, "Allow making AMIs public by sharing with the 'all' account")
+}
+
+func addShareTargetFlags(flags *pflag.FlagSet, verb string) {
+	flags.StringSliceP("account", "a", []string{""}, "(optional, multiple) AWS accounts (IDs or config file aliases) to " + verb)
+	flags.StringSlice("organization-arn", []string{""}, "(optional, multiple) AWS Organizations to " + verb)
+	flags.StringSlice("ou-arn", []string{""}, "(optional, multiple) AWS Organizations organizational units to " + verb)
+}
+
+// newShareTargets reads the flags defined by addShareTargetFlags (or their
+// config file equivalents) from viper. Accounts can be given by their alias
+// in the accounts section of the config file, and 'all' means public.
+func newShareTargets() shareTargets {
+	targets := shareTargets{
+		organizationArns: nonEmpty(viper.GetStringSlice("organization-arn")),
+		ouArns: nonEmpty(viper.GetStringSlice("ou-arn")),
+	}
+
+	for _, account := range nonEmpty(viper.GetStringSlice("account")) {
+		if account == ec2.PermissionGroupAll {
+			targets.groups = append(targets.groups, account)
+		} else {
+			targets.accounts = append(targets.accounts, resolveAccount(account))
+		}
+	}
+
+	return targets
+}
+
+func newShareOptions() shareOptions {
+	return shareOptions{
+		targets: newShareTargets(),
+		exact: viper.GetBool("exact"),
+		allowPublic: viper.GetBool("allow-public"),
+		concurrency: viper.GetInt("concurrency"),
+		waitTimeout: viper.GetDuration("wait-timeout"),
+	}
+}
+
+// validate catches what can be caught before any images exist.
+func (o shareOptions) validate() error {
+	if o.targets.public() && !o.allowPublic {
+		return fmt.Errorf("refusing to make AMIs public without --allow-public")
+	}
+	return nil
+}
+
+// enabled reports whether anything needs doing. In exact mode an empty target
+// list is meaningful: it unshares the images from everyone.
+func (o shareOptions) enabled() bool {
+	return o.exact || !o.targets.empty()
+}
+
+// shareAmiUi shares the AMI in each region as soon as it is available, rather
+// than waiting for every region's copy first. Regions are shared in
+// concurrently.
+func shareAmiUi(sess *session.Session, regionalAmis map[string]string, opts shareOptions) error {
 	boldBlue := color.New(color.FgBlue, color.Bold)
 
-	if len(accounts) > 0 {
-		boldBlue.Fprint(os.Stderr, "Sharing AMIs with other accounts\n")
+	if !opts.enabled() { return nil }
+
+	boldBlue.Fprint(os.Stderr, "Sharing AMIs with other accounts\n")
+
+	if len(opts.targets.organizationArns) > 0 || len(opts.targets.ouArns) > 0 {
+		color.New(color.FgYellow).Fprintln(os.Stderr, "Snapshots can't be shared with organizations or OUs, so they are only granted launch permission")
+	}
+
+	regions := []string{}
+	for region := range regionalAmis {
+		regions = append(regions, region)
+	}
+
+	// every region waits for its copy at once, so that each is shared as soon
+	// as it is available; only the API calls count towards the concurrency
+	limit := newLimiter(opts.concurrency)
 
-		for region, amiId := range regionalAmis {
-			regionSess := sess.Copy(&aws.Config{Region: &region})
-			shareAmi(regionSess, amiId, accounts)
-			blue.Fprintf(os.Stderr, "Shared %s with %v\n", amiId, accounts)
+	return eachRegion(regions, 0, func(region string) error {
+		amiId := regionalAmis[region]
+		regionSess := sess.Copy(&aws.Config{Region: aws.String(region)})
+
+		if err := waitForImage(regionSess, amiId, opts.waitTimeout, limit); err != nil { return err }
+
+		var result *shareResult
+		err := limit.do(func() error {
+			var err error
+			result, err = shareAmi(regionSess, amiId, opts)
+			return err
+		})
+		if err != nil { return err }
+
+		if opts.exact {
+			regionProgress(color.New(color.FgBlue), region, "shared %s and snapshots %v with exactly %s", amiId, result.plan.snapshotIds, opts.targets)
+		} else {
+			regionProgress(color.New(color.FgBlue), region, "shared %s and snapshots %v with %s", amiId, result.plan.snapshotIds, opts.targets)
 		}
+		printKmsKeyRequirements(region, result, opts.targets)
+		return nil
+	})
+}
+
+// printKmsKeyRequirements tells the user which KMS keys the target accounts
+// must be granted use of before they can launch an encrypted shared image.
+func printKmsKeyRequirements(region string, result *shareResult, targets shareTargets) {
+	yellow := color.New(color.FgYellow)
+	red := color.New(color.FgRed)
+
+	for _, key := range result.kmsKeys {
+		if key.awsManaged {
+			regionProgress(red, region, "%s is encrypted with the AWS managed key %s, which can't be shared. Copy it with a customer managed key (--kms-key) first.", result.plan.amiId, key.keyId)
+			continue
+		}
+
+		regionProgress(yellow, region, "%s need kms:Decrypt, kms:DescribeKey, kms:CreateGrant, kms:ReEncrypt* and kms:GenerateDataKey* on %s", targets, key.keyId)
 	}
 }
 
-func amiName(sess *session.Session, amiId string) string {
+func describeImage(sess *session.Session, amiId string) (*ec2.Image, error) {
 	api := ec2.New(sess)
-	resp, _ := api.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{&amiId}})
-	return *resp.Images[0].Name
+	resp, err := api.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{&amiId}})
+	if err != nil { return nil, err }
+	if len(resp.Images) == 0 { return nil, fmt.Errorf("AMI %s not found in %s", amiId, *sess.Config.Region) }
+	return resp.Images[0], nil
+}
+
+type shareResult struct {
+	plan    *sharingPlan
+	kmsKeys []shareKmsKey
 }
 
-func shareAmi(sess *session.Session, amiId string, accounts []string) {
+type shareKmsKey struct {
+	keyId      string
+	awsManaged bool
+}
+
+// shareAmi grants targets launch permission on the image and (for accounts)
+// create volume permission on its EBS snapshots, so that they can also copy
+// the image and create volumes from it. In exact mode, the plan is printed
+// before it is applied. The resulting permissions are read back to verify
+// them. The image must be available.
+func shareAmi(sess *session.Session, amiId string, opts shareOptions) (*shareResult, error) {
 	api := ec2.New(sess)
 
-	permissions := []*ec2.LaunchPermission{}
-	for _, account := range accounts {
-		permissions = append(permissions, &ec2.LaunchPermission{
-			UserId: aws.String(account),
+	image, err := describeImage(sess, amiId)
+	if err != nil { return nil, err }
+
+	if err := checkPublic(api, image, opts); err != nil { return nil, err }
+
+	plan := planSharing(image, opts.targets, shareTargets{})
+	if opts.exact {
+		plan, err = planExactSharing(api, image, opts.targets)
+		if err != nil { return nil, err }
+		plan.print(*sess.Config.Region)
+	}
+
+	if err := plan.apply(api); err != nil { return nil, err }
+	if err := plan.verify(api); err != nil { return nil, err }
+
+	kmsKeys, err := imageKmsKeys(sess, image)
+	if err != nil { return nil, err }
+
+	return &shareResult{plan: plan, kmsKeys: kmsKeys}, nil
+}
+
+// imageKmsKeys describes the KMS keys that the image's snapshots are
+// encrypted with.
+func imageKmsKeys(sess *session.Session, image *ec2.Image) ([]shareKmsKey, error) {
+	keyIds := []string{}
+
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs == nil { continue }
+
+		if aws.BoolValue(mapping.Ebs.Encrypted) && mapping.Ebs.KmsKeyId != nil && !stringInSlice(*mapping.Ebs.KmsKeyId, keyIds) {
+			keyIds = append(keyIds, *mapping.Ebs.KmsKeyId)
+		}
+	}
+
+	kmsApi := kms.New(sess)
+	keys := []shareKmsKey{}
+
+	for _, keyId := range keyIds {
+		resp, err := kmsApi.DescribeKey(&kms.DescribeKeyInput{KeyId: aws.String(keyId)})
+		if err != nil { return nil, err }
+
+		keys = append(keys, shareKmsKey{
+			keyId: keyId,
+			awsManaged: aws.StringValue(resp.KeyMetadata.KeyManager) == kms.KeyManagerTypeAws,
 		})
 	}
 
-	api.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
-		ImageId: &amiId,
-		LaunchPermission: &ec2.LaunchPermissionModifications{
-			Add: permissions,
-		},
-	})
+	return keys, nil
 }
 
 
 func init() {
 	utilCmd.AddCommand(shareCmd)
 	shareCmd.PersistentFlags().String("image-id", "", "AMI ID to share")
-	shareCmd.PersistentFlags().StringSliceP("account", "a", []string{""}, "(optional, multiple) AWS accounts to share AMI with")
+	shareCmd.PersistentFlags().Int("concurrency", 4, "Maximum number of regions to share in at once")
+	shareCmd.PersistentFlags().Duration("wait-timeout", 2 * time.Hour, "Give up if the AMI isn't available to share after this long (0 to wait forever)")
+	addShareFlags(shareCmd.PersistentFlags())
+	addDistributeFlags(shareCmd.PersistentFlags())
+	shareCmd.PersistentFlags().Bool("keep-partial", false, "Don't deregister the AMIs copied into target accounts by this run if a copy fails")
 }
@@ -0,0 +1,345 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fatih/color"
+)
+
+// shareTargets are the principals an AMI is shared with.
+type shareTargets struct {
+	accounts         []string
+	organizationArns []string
+	ouArns           []string
+	// groups can only be "all", i.e. public
+	groups []string
+}
+
+func (t shareTargets) empty() bool {
+	return len(t.accounts) == 0 && len(t.organizationArns) == 0 && len(t.ouArns) == 0 && len(t.groups) == 0
+}
+
+func (t shareTargets) String() string {
+	all := append(append(append([]string{}, t.accounts...), t.organizationArns...), t.ouArns...)
+	for _, group := range t.groups {
+		all = append(all, "group="+group)
+	}
+	return fmt.Sprintf("[%s]", strings.Join(all, ", "))
+}
+
+func (t shareTargets) launchPermissions() []*ec2.LaunchPermission {
+	permissions := []*ec2.LaunchPermission{}
+
+	for _, account := range t.accounts {
+		permissions = append(permissions, &ec2.LaunchPermission{UserId: aws.String(account)})
+	}
+	for _, arn := range t.organizationArns {
+		permissions = append(permissions, &ec2.LaunchPermission{OrganizationArn: aws.String(arn)})
+	}
+	for _, arn := range t.ouArns {
+		permissions = append(permissions, &ec2.LaunchPermission{OrganizationalUnitArn: aws.String(arn)})
+	}
+	for _, group := range t.groups {
+		permissions = append(permissions, &ec2.LaunchPermission{Group: aws.String(group)})
+	}
+
+	return permissions
+}
+
+// snapshotTargets drops the organizations and OUs, as snapshots can only be
+// shared with accounts (or made public).
+func (t shareTargets) snapshotTargets() shareTargets {
+	return shareTargets{accounts: t.accounts, groups: t.groups}
+}
+
+func (t shareTargets) createVolumePermissions() []*ec2.CreateVolumePermission {
+	permissions := []*ec2.CreateVolumePermission{}
+
+	for _, account := range t.accounts {
+		permissions = append(permissions, &ec2.CreateVolumePermission{UserId: aws.String(account)})
+	}
+	for _, group := range t.groups {
+		permissions = append(permissions, &ec2.CreateVolumePermission{Group: aws.String(group)})
+	}
+
+	return permissions
+}
+
+// minus returns the targets in t that aren't in other.
+func (t shareTargets) minus(other shareTargets) shareTargets {
+	diff := func(a, b []string) []string {
+		ret := []string{}
+		for _, str := range a {
+			if !stringInSlice(str, b) {
+				ret = append(ret, str)
+			}
+		}
+		return ret
+	}
+
+	return shareTargets{
+		accounts:         diff(t.accounts, other.accounts),
+		organizationArns: diff(t.organizationArns, other.organizationArns),
+		ouArns:           diff(t.ouArns, other.ouArns),
+		groups:           diff(t.groups, other.groups),
+	}
+}
+
+// intersect returns the targets in t that are also in other.
+func (t shareTargets) intersect(other shareTargets) shareTargets {
+	return t.minus(t.minus(other))
+}
+
+func launchPermissionTargets(permissions []*ec2.LaunchPermission) shareTargets {
+	t := shareTargets{}
+
+	for _, permission := range permissions {
+		switch {
+		case permission.UserId != nil:
+			t.accounts = append(t.accounts, *permission.UserId)
+		case permission.OrganizationArn != nil:
+			t.organizationArns = append(t.organizationArns, *permission.OrganizationArn)
+		case permission.OrganizationalUnitArn != nil:
+			t.ouArns = append(t.ouArns, *permission.OrganizationalUnitArn)
+		case permission.Group != nil:
+			t.groups = append(t.groups, *permission.Group)
+		}
+	}
+
+	return t
+}
+
+func createVolumePermissionTargets(permissions []*ec2.CreateVolumePermission) shareTargets {
+	t := shareTargets{}
+
+	for _, permission := range permissions {
+		switch {
+		case permission.UserId != nil:
+			t.accounts = append(t.accounts, *permission.UserId)
+		case permission.Group != nil:
+			t.groups = append(t.groups, *permission.Group)
+		}
+	}
+
+	return t
+}
+
+type permissionDiff struct {
+	add    shareTargets
+	remove shareTargets
+}
+
+func (d permissionDiff) empty() bool {
+	return d.add.empty() && d.remove.empty()
+}
+
+// sharingPlan is the set of permission changes needed to share (or unshare)
+// an image and its EBS snapshots.
+type sharingPlan struct {
+	amiId       string
+	launch      permissionDiff
+	snapshotIds []string
+	snapshots   map[string]permissionDiff
+}
+
+func imageSnapshotIds(image *ec2.Image) []string {
+	ids := []string{}
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+			ids = append(ids, *mapping.Ebs.SnapshotId)
+		}
+	}
+	return ids
+}
+
+// planSharing adds and removes the given targets regardless of the image's
+// current permissions.
+func planSharing(image *ec2.Image, add, remove shareTargets) *sharingPlan {
+	plan := &sharingPlan{
+		amiId:       *image.ImageId,
+		launch:      permissionDiff{add: add, remove: remove},
+		snapshotIds: imageSnapshotIds(image),
+		snapshots:   map[string]permissionDiff{},
+	}
+
+	for _, snapshotId := range plan.snapshotIds {
+		plan.snapshots[snapshotId] = permissionDiff{add: add.snapshotTargets(), remove: remove.snapshotTargets()}
+	}
+
+	return plan
+}
+
+// planExactSharing compares the image's (and snapshots') current permissions
+// with desired and plans the adds and removes that make them match exactly.
+func planExactSharing(api *ec2.EC2, image *ec2.Image, desired shareTargets) (*sharingPlan, error) {
+	plan := &sharingPlan{
+		amiId:       *image.ImageId,
+		snapshotIds: imageSnapshotIds(image),
+		snapshots:   map[string]permissionDiff{},
+	}
+
+	current, err := currentLaunchTargets(api, *image.ImageId)
+	if err != nil { return nil, err }
+
+	plan.launch = exactDiff(current, desired)
+
+	for _, snapshotId := range plan.snapshotIds {
+		currentSnapshot, err := currentSnapshotTargets(api, snapshotId)
+		if err != nil { return nil, err }
+
+		plan.snapshots[snapshotId] = exactDiff(currentSnapshot, desired.snapshotTargets())
+	}
+
+	return plan, nil
+}
+
+// exactDiff is what to add and remove to turn current into desired.
+func exactDiff(current, desired shareTargets) permissionDiff {
+	return permissionDiff{add: desired.minus(current), remove: current.minus(desired)}
+}
+
+func currentLaunchTargets(api *ec2.EC2, amiId string) (shareTargets, error) {
+	resp, err := api.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
+		ImageId:   aws.String(amiId),
+		Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+	})
+	if err != nil { return shareTargets{}, err }
+
+	return launchPermissionTargets(resp.LaunchPermissions), nil
+}
+
+func currentSnapshotTargets(api *ec2.EC2, snapshotId string) (shareTargets, error) {
+	resp, err := api.DescribeSnapshotAttribute(&ec2.DescribeSnapshotAttributeInput{
+		SnapshotId: aws.String(snapshotId),
+		Attribute:  aws.String(ec2.SnapshotAttributeNameCreateVolumePermission),
+	})
+	if err != nil { return shareTargets{}, err }
+
+	return createVolumePermissionTargets(resp.CreateVolumePermissions), nil
+}
+
+func (p *sharingPlan) print(region string) {
+	green := color.New(color.FgGreen)
+	red := color.New(color.FgRed)
+
+	if p.launch.empty() {
+		regionProgress(color.New(color.FgBlue), region, "%s launch permissions are up to date", p.amiId)
+	}
+	if !p.launch.add.empty() {
+		regionProgress(green, region, "%s + launch %s", p.amiId, p.launch.add)
+	}
+	if !p.launch.remove.empty() {
+		regionProgress(red, region, "%s - launch %s", p.amiId, p.launch.remove)
+	}
+
+	for _, snapshotId := range p.snapshotIds {
+		diff := p.snapshots[snapshotId]
+		if !diff.add.empty() {
+			regionProgress(green, region, "%s + create volume %s", snapshotId, diff.add)
+		}
+		if !diff.remove.empty() {
+			regionProgress(red, region, "%s - create volume %s", snapshotId, diff.remove)
+		}
+	}
+}
+
+func (p *sharingPlan) apply(api *ec2.EC2) error {
+	if !p.launch.empty() {
+		_, err := api.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+			ImageId: aws.String(p.amiId),
+			LaunchPermission: &ec2.LaunchPermissionModifications{
+				Add:    p.launch.add.launchPermissions(),
+				Remove: p.launch.remove.launchPermissions(),
+			},
+		})
+		if err != nil { return err }
+	}
+
+	for _, snapshotId := range p.snapshotIds {
+		diff := p.snapshots[snapshotId]
+		if diff.empty() { continue }
+
+		_, err := api.ModifySnapshotAttribute(&ec2.ModifySnapshotAttributeInput{
+			SnapshotId: aws.String(snapshotId),
+			Attribute:  aws.String(ec2.SnapshotAttributeNameCreateVolumePermission),
+			CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
+				Add:    diff.add.createVolumePermissions(),
+				Remove: diff.remove.createVolumePermissions(),
+			},
+		})
+		if err != nil { return err }
+	}
+
+	return nil
+}
+
+// verify re-reads the image's and snapshots' permissions and checks that the
+// plan took effect: everyone added is present and everyone removed is gone.
+// Permission changes can take a moment to be visible, so it retries briefly
+// before giving up.
+func (p *sharingPlan) verify(api *ec2.EC2) error {
+	var err error
+
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(2 * time.Second)
+		}
+
+		err = p.check(api)
+		if err == nil { return nil }
+	}
+
+	return err
+}
+
+func (p *sharingPlan) check(api *ec2.EC2) error {
+	problems := []string{}
+
+	current, err := currentLaunchTargets(api, p.amiId)
+	if err != nil { return err }
+
+	if missing := p.launch.add.minus(current); !missing.empty() {
+		problems = append(problems, fmt.Sprintf("%s launch permission missing for %s", p.amiId, missing))
+	}
+	if remaining := p.launch.remove.intersect(current); !remaining.empty() {
+		problems = append(problems, fmt.Sprintf("%s launch permission still granted to %s", p.amiId, remaining))
+	}
+
+	for _, snapshotId := range p.snapshotIds {
+		diff := p.snapshots[snapshotId]
+		if diff.empty() { continue }
+
+		current, err := currentSnapshotTargets(api, snapshotId)
+		if err != nil { return err }
+
+		if missing := diff.add.minus(current); !missing.empty() {
+			problems = append(problems, fmt.Sprintf("%s create volume permission missing for %s", snapshotId, missing))
+		}
+		if remaining := diff.remove.intersect(current); !remaining.empty() {
+			problems = append(problems, fmt.Sprintf("%s create volume permission still granted to %s", snapshotId, remaining))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("sharing verification failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import "testing"
+
+const (
+	orgArn = "arn:aws:organizations::111111111111:organization/o-abc123"
+	ouArn  = "arn:aws:organizations::111111111111:ou/o-abc123/ou-ab12-cd34"
+)
+
+func TestShareTargetsMinus(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     shareTargets
+		expected string
+	}{
+		{"empty", shareTargets{}, shareTargets{}, "[]"},
+		{"nothing removed", shareTargets{accounts: []string{"1", "2"}}, shareTargets{}, "[1, 2]"},
+		{"account removed", shareTargets{accounts: []string{"1", "2"}}, shareTargets{accounts: []string{"2", "3"}}, "[1]"},
+		{"everything removed", shareTargets{accounts: []string{"1"}, groups: []string{"all"}}, shareTargets{accounts: []string{"1"}, groups: []string{"all"}}, "[]"},
+		{
+			"kinds kept apart",
+			shareTargets{accounts: []string{"1"}, organizationArns: []string{orgArn}, ouArns: []string{ouArn}},
+			shareTargets{organizationArns: []string{ouArn}, ouArns: []string{orgArn}},
+			"[1, " + orgArn + ", " + ouArn + "]",
+		},
+		{"group", shareTargets{accounts: []string{"1"}, groups: []string{"all"}}, shareTargets{accounts: []string{"1"}}, "[group=all]"},
+	}
+
+	for _, test := range tests {
+		if actual := test.a.minus(test.b).String(); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestShareTargetsIntersect(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     shareTargets
+		expected string
+	}{
+		{"empty", shareTargets{}, shareTargets{accounts: []string{"1"}}, "[]"},
+		{"accounts", shareTargets{accounts: []string{"1", "2"}}, shareTargets{accounts: []string{"2", "3"}}, "[2]"},
+		{
+			"orgs, OUs and groups",
+			shareTargets{organizationArns: []string{orgArn}, ouArns: []string{ouArn}, groups: []string{"all"}},
+			shareTargets{organizationArns: []string{orgArn}, groups: []string{"all"}},
+			"[" + orgArn + ", group=all]",
+		},
+	}
+
+	for _, test := range tests {
+		if actual := test.a.intersect(test.b).String(); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestExactDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     shareTargets
+		desired     shareTargets
+		add, remove string
+	}{
+		{"up to date", shareTargets{accounts: []string{"1"}}, shareTargets{accounts: []string{"1"}}, "[]", "[]"},
+		{"new account", shareTargets{accounts: []string{"1"}}, shareTargets{accounts: []string{"1", "2"}}, "[2]", "[]"},
+		{"stale account", shareTargets{accounts: []string{"1", "2"}}, shareTargets{accounts: []string{"2"}}, "[]", "[1]"},
+		{"swapped account", shareTargets{accounts: []string{"1"}}, shareTargets{accounts: []string{"2"}}, "[2]", "[1]"},
+		{
+			"org replaced by OU",
+			shareTargets{organizationArns: []string{orgArn}},
+			shareTargets{ouArns: []string{ouArn}},
+			"[" + ouArn + "]",
+			"[" + orgArn + "]",
+		},
+		{"made private", shareTargets{accounts: []string{"1"}, groups: []string{"all"}}, shareTargets{accounts: []string{"1"}}, "[]", "[group=all]"},
+		{"made public", shareTargets{}, shareTargets{groups: []string{"all"}}, "[group=all]", "[]"},
+		{
+			"empty desired removes everything",
+			shareTargets{accounts: []string{"1", "2"}, organizationArns: []string{orgArn}, ouArns: []string{ouArn}, groups: []string{"all"}},
+			shareTargets{},
+			"[]",
+			"[1, 2, " + orgArn + ", " + ouArn + ", group=all]",
+		},
+	}
+
+	for _, test := range tests {
+		diff := exactDiff(test.current, test.desired)
+		if actual := diff.add.String(); actual != test.add {
+			t.Errorf("%s: expected to add %s, got %s", test.name, test.add, actual)
+		}
+		if actual := diff.remove.String(); actual != test.remove {
+			t.Errorf("%s: expected to remove %s, got %s", test.name, test.remove, actual)
+		}
+	}
+}
+
+func TestExactDiffSnapshots(t *testing.T) {
+	// snapshots can't be shared with organizations or OUs, so their accounts
+	// are diffed without them
+	desired := shareTargets{accounts: []string{"2"}, organizationArns: []string{orgArn}, ouArns: []string{ouArn}}
+	current := shareTargets{accounts: []string{"1"}}
+
+	diff := exactDiff(current, desired.snapshotTargets())
+	if actual := diff.add.String(); actual != "[2]" {
+		t.Errorf("expected to add [2], got %s", actual)
+	}
+	if actual := diff.remove.String(); actual != "[1]" {
+		t.Errorf("expected to remove [1], got %s", actual)
+	}
+}
@@ -19,23 +19,103 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/glassechidna/ami-automation/shared"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"encoding/json"
+	"fmt"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
 )
 
 var showCmd = &cobra.Command{
-	Use:   "show",
+	Use:   "show EXEC_ID",
 	Short: "Show output of SSM automation that has already happened",
+	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		execId := args[0]
-		show(execId)
+
+		flags := cmd.PersistentFlags()
+		follow, _ := flags.GetBool("follow")
+		steps, _ := flags.GetStringSlice("step")
+		failedOnly, _ := flags.GetBool("failed-only")
+		outputsOnly, _ := flags.GetBool("outputs-only")
+		raw, _ := flags.GetBool("raw")
+
+		sess := awsSession()
+
+		switch {
+		case raw:
+			exitOnError(showRaw(sess, execId, follow))
+		case outputsOnly:
+			exitOnError(showOutputs(sess, execId, follow))
+		default:
+			show(sess, execId, follow, stepFilter(nonEmpty(steps), failedOnly))
+		}
 	},
 }
 
-func show(execId string) {
-	sess := awsSession()
+func show(sess *session.Session, execId string, follow bool, filter shared.StepFilter) {
 	reporter := shared.NewStatusReporter(sess, execId)
+	reporter.SetFollow(follow)
+	reporter.FilterSteps(filter)
 	reporter.Print()
 }
 
+// stepFilter only lets through the named steps (if any are given) and, if
+// failedOnly, steps that didn't succeed.
+func stepFilter(names []string, failedOnly bool) shared.StepFilter {
+	return func(step *ssm.StepExecution) bool {
+		if len(names) > 0 && !stringInSlice(*step.StepName, names) {
+			return false
+		}
+		if failedOnly && *step.StepStatus == ssm.AutomationExecutionStatusSuccess {
+			return false
+		}
+		return true
+	}
+}
+
+// getExecution describes the execution, first waiting for it to finish if
+// follow is set.
+func getExecution(sess *session.Session, execId string, follow bool) (*ssm.AutomationExecution, error) {
+	api := ssm.New(sess)
+
+	for {
+		resp, err := api.GetAutomationExecution(&ssm.GetAutomationExecutionInput{AutomationExecutionId: &execId})
+		if err != nil { return nil, err }
+
+		exec := resp.AutomationExecution
+		if !follow || shared.IsTerminalStatus(aws.StringValue(exec.AutomationExecutionStatus)) {
+			return exec, nil
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// showRaw prints the execution as the API returns it.
+func showRaw(sess *session.Session, execId string, follow bool) error {
+	exec, err := getExecution(sess, execId, follow)
+	if err != nil { return err }
+
+	bytes, err := json.MarshalIndent(exec, "", "  ")
+	if err != nil { return err }
+
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// showOutputs prints just the document's outputs, as JSON.
+func showOutputs(sess *session.Session, execId string, follow bool) error {
+	exec, err := getExecution(sess, execId, follow)
+	if err != nil { return err }
+
+	bytes, err := json.MarshalIndent(exec.Outputs, "", "  ")
+	if err != nil { return err }
+
+	fmt.Println(string(bytes))
+	return nil
+}
+
 func awsSession() *session.Session {
 	sessOpts := session.Options{
 		SharedConfigState: session.SharedConfigEnable,
@@ -47,15 +127,9 @@ func awsSession() *session.Session {
 
 func init() {
 	RootCmd.AddCommand(showCmd)
-
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// showCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// showCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-
+	showCmd.PersistentFlags().BoolP("follow", "f", false, "Keep polling until the execution finishes")
+	showCmd.PersistentFlags().StringSlice("step", []string{""}, "(optional, multiple) only show these steps")
+	showCmd.PersistentFlags().Bool("failed-only", false, "Only show steps that didn't succeed")
+	showCmd.PersistentFlags().Bool("outputs-only", false, "Only print the document's outputs, as JSON")
+	showCmd.PersistentFlags().Bool("raw", false, "Print the execution as JSON, as returned by the SSM API")
 }
@@ -26,6 +26,9 @@ import (
 	"fmt"
 	"log"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"sort"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
 )
 
 var startCmd = &cobra.Command{
@@ -38,35 +41,130 @@ var startCmd = &cobra.Command{
 		rawParameters := viper.GetStringSlice("parameter")
 		params := parseRawParameters(rawParameters)
 
-		accounts := viper.GetStringSlice("account")
-		regions := viper.GetStringSlice("region")
+		shareOpts := newShareOptions()
+		exitOnError(shareOpts.validate())
+
+		distOpts, err := newDistributeOptions()
+		exitOnError(err)
+
+		copyOpts, err := newCopyOptions()
+		exitOnError(err)
 
 		shouldWait := viper.GetBool("copy-wait")
 
-		if len(accounts) > 0 && !shouldWait {
-			fmt.Fprintln(os.Stderr, "You must wait (-w) if you want to share AMIs with other accounts. See GitHub issue #1.")
-			os.Exit(1)
+		executionTags, err := parseKeyValues(viper.GetStringSlice("execution-tag"))
+		exitOnError(err)
+
+		attach := viper.GetBool("attach-if-running")
+		if attach && len(executionTags) == 0 {
+			exitOnError(fmt.Errorf("--attach-if-running needs at least one --execution-tag to recognise the execution by"))
+		}
+
+		retries := viper.GetInt("retries")
+		retryDelay := viper.GetDuration("retry-delay")
+		policy := newRetryPolicy()
+
+		mode := ssm.ExecutionModeAuto
+		if viper.GetBool("interactive") {
+			if !stdinIsTerminal() {
+				exitOnError(fmt.Errorf("--interactive needs a terminal to prompt on"))
+			}
+			mode = ssm.ExecutionModeInteractive
 		}
 
 		sess := awsSession()
 
-		execId, err := start(sess, name, version, params, accounts, regions)
-		if err != nil { log.Panic(err.Error()) }
+		regions, err := resolveRegions(sess, viper.GetStringSlice("region"), viper.GetStringSlice("exclude-region"))
+		exitOnError(err)
+		exitOnError(copyOpts.validate(copyTargets(aws.StringValue(sess.Config.Region), regions)))
+
+		// with --from-execution the build has already happened and only the
+		// copying and sharing are (re)done, reusing any copies made before
+		fromExecution := viper.GetString("from-execution")
+		execId := fromExecution
+
+		// a finished build given with --from-execution is never restarted
+		if len(fromExecution) > 0 {
+			retries = 0
+		}
+
+		if len(execId) == 0 && attach {
+			running, err := runningExecution(sess, name, executionTags)
+			exitOnError(err)
+
+			if running != nil {
+				color.New(color.FgBlue).Fprintf(os.Stderr, "Attaching to %s, which is already %s\n", running.ExecutionId, running.Status)
+				execId = running.ExecutionId
+				mode = running.Mode
+			}
+		}
+
+		if len(execId) == 0 {
+			execId, err = start(sess, name, version, mode, params, executionTags, shareOpts.targets.accounts, regions)
+			if err != nil { log.Panic(err.Error()) }
+		}
+
+		attempts := []string{execId}
+		reporter := followExecution(sess, execId, mode, "")
+
+		for retry := 1; retry <= retries && !reporter.Success(); retry++ {
+			failure, err := failedStep(sess, execId)
+			exitOnError(err)
+
+			if !policy.retryable(failure) {
+				color.New(color.FgRed).Fprintf(os.Stderr, "Not retrying, failure isn't retryable: %s\n", failure)
+				break
+			}
+
+			retryMode := mode
+			fromStep, err := policy.rerunFrom(sess, failure)
+			exitOnError(err)
+			if len(fromStep) > 0 {
+				retryMode = ssm.ExecutionModeInteractive
+			}
+
+			color.New(color.FgYellow).Fprintf(os.Stderr, "Attempt %d of %d failed: %s\n", retry, retries+1, failure)
+			time.Sleep(retryDelay)
 
-		reporter := shared.NewStatusReporter(sess, execId)
-		reporter.Print()
+			execId, err = start(sess, name, version, retryMode, params, executionTags, shareOpts.targets.accounts, regions)
+			exitOnError(err)
+			attempts = append(attempts, execId)
+
+			if len(fromStep) > 0 {
+				color.New(color.FgYellow).Fprintf(os.Stderr, "Retrying from %s\n", fromStep)
+			}
+			reporter = followExecution(sess, execId, mode, fromStep)
+		}
 
 		if !reporter.Success() {
+			if len(attempts) > 1 {
+				color.New(color.FgRed).Fprintf(os.Stderr, "All attempts failed: %s\n", strings.Join(attempts, ", "))
+			}
 			os.Exit(1)
 		}
 
-		amiId := reporter.AmiIds()[0]
-		regionalAmis := copyAmiUi(sess, amiId, regions)
+		amiIds := reporter.AmiIds()
+		if len(amiIds) == 0 {
+			exitOnError(fmt.Errorf("execution %s didn't create an AMI", execId))
+		}
+
+		amiId := amiIds[0]
+		regionalAmis, err := copyAmiUi(sess, amiId, regions, copyOpts)
+		rollbackOnError(sess, copyOpts, err)
+
+		rollbackOnError(sess, copyOpts, shareAmiUi(sess, regionalAmis, shareOpts))
+
+		accountAmis, err := distributeAmiUi(sess, regionalAmis, shareOpts.targets.accounts, distOpts, copyOpts.concurrency, copyOpts.journal)
+		rollbackOnError(sess, copyOpts, err)
+
+		var snapshots map[string][]shared.SnapshotState
 
 		if shouldWait {
 			color.New(color.FgBlue).Fprintln(os.Stderr, "Waiting for copied AMIs to be available")
-			wait(sess, regionalAmis)
-			shareAmiUi(sess, regionalAmis, accounts)
+			rollbackOnError(sess, copyOpts, wait(sess, amiLists(regionalAmis), copyOpts.concurrency, copyOpts.waitTimeout))
+
+			snapshots, err = snapshotEncryptionUi(sess, regionalAmis)
+			exitOnError(err)
 		}
 
 		output := shared.OutputFormat{
@@ -74,6 +172,9 @@ var startCmd = &cobra.Command{
 			AmiId: amiId,
 			AmiIds: regionalAmis,
 			WaitCommand: makeWaitCommand(regionalAmis),
+			Snapshots: snapshots,
+			AccountAmiIds: accountAmis,
+			ExecutionIds: attempts,
 		}
 
 		outputBytes, _ := json.MarshalIndent(output, "", "  ")
@@ -81,11 +182,34 @@ var startCmd = &cobra.Command{
 	},
 }
 
+// followExecution prints the execution's steps as they finish until it is
+// done, handling approvals and starting the steps of interactive executions:
+// prompting for each one, or skipping to fromStep when re-running.
+func followExecution(sess *session.Session, execId, mode, fromStep string) *shared.StatusReporter {
+	reporter := shared.NewStatusReporter(sess, execId)
+	reporter.OnWaiting(approvalHandler(sess, execId))
+
+	if len(fromStep) > 0 {
+		reporter.OnIdle(rerunHandler(sess, execId, fromStep))
+	} else if mode == ssm.ExecutionModeInteractive {
+		reporter.OnIdle(interactiveHandler(sess, execId))
+	}
+
+	reporter.Print()
+	return reporter
+}
+
 func makeWaitCommand(amiIds map[string]string) string {
 	cmd := fmt.Sprintf("%s util wait", os.Args[0])
 
-	for region, amiId := range amiIds {
-		cmd = fmt.Sprintf("%s -i %s -r %s", cmd, amiId, region)
+	regions := []string{}
+	for region := range amiIds {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	for _, region := range regions {
+		cmd = fmt.Sprintf("%s -i %s:%s", cmd, region, amiIds[region])
 	}
 
 	return cmd
@@ -109,18 +233,23 @@ func parseRawParameters(rawParameters []string) map[string][]*string {
 	return params
 }
 
-func start(sess *session.Session, name, version string, parameters map[string][]*string, accounts, regions []string) (string, error) {
+func start(sess *session.Session, name, version, mode string, parameters map[string][]*string, tags map[string]string, accounts, regions []string) (string, error) {
 	api := ssm.New(sess)
 
 	input := &ssm.StartAutomationExecutionInput{
 		DocumentName:    &name,
 		Parameters:      parameters,
+		Mode:            &mode,
 	}
 
 	if len(version) > 0 {
 		input.DocumentVersion = &version
 	}
 
+	if len(tags) > 0 {
+		input.Tags = ssmTags(tags)
+	}
+
 	resp, err := api.StartAutomationExecution(input)
 	if err != nil { return "", err }
 
@@ -128,15 +257,33 @@ func start(sess *session.Session, name, version string, parameters map[string][]
 	return execId, nil
 }
 
+// ssmTags converts a map of tags into SSM API tags, sorted by key.
+func ssmTags(tags map[string]string) []*ssm.Tag {
+	ret := []*ssm.Tag{}
+	for _, tag := range ec2Tags(tags) {
+		ret = append(ret, &ssm.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return ret
+}
+
 func init() {
 	RootCmd.AddCommand(startCmd)
 
 	startCmd.PersistentFlags().String("name", "", "SSM Automation document name")
 	startCmd.PersistentFlags().String("version", "", "(optional) document version")
+	startCmd.PersistentFlags().String("from-execution", "", "(optional) don't start an execution; copy and share the AMI built by this one")
+	startCmd.PersistentFlags().Bool("interactive", false, "Run the document step by step, prompting before each step")
 	startCmd.PersistentFlags().StringSliceP("parameter", "p", []string{""}, "(optional, multiple) document input parameters")
-	startCmd.PersistentFlags().StringSliceP("region", "r", []string{""}, "(optional, multiple) AWS regions to copy AMI to")
-	startCmd.PersistentFlags().StringSliceP("account", "a", []string{""}, "(optional, multiple) AWS accounts to share AMI with")
+	startCmd.PersistentFlags().StringSlice("execution-tag", []string{""}, "(optional, multiple) key=value tags for the execution, e.g. pipeline=123")
+	startCmd.PersistentFlags().Bool("attach-if-running", false, "Follow an unfinished execution of the document with the same execution tags instead of starting another")
+	startCmd.PersistentFlags().Int("retries", 0, "Restart the execution up to this many times if it fails in a way the retry-policy in the config file allows")
+	startCmd.PersistentFlags().Duration("retry-delay", 30 * time.Second, "How long to wait before retrying a failed execution")
+	startCmd.PersistentFlags().StringSliceP("region", "r", []string{""}, "(optional, multiple) AWS regions to copy AMI to, 'all' or a region group from the config file")
+	startCmd.PersistentFlags().StringSlice("exclude-region", []string{""}, "(optional, multiple) AWS regions not to copy AMI to")
+	addShareFlags(startCmd.PersistentFlags())
+	addDistributeFlags(startCmd.PersistentFlags())
 	startCmd.PersistentFlags().BoolP("copy-wait", "w", false, "Wait for copied images to be available")
+	addCopyFlags(startCmd.PersistentFlags())
 
 	viper.BindPFlags(startCmd.PersistentFlags())
 }
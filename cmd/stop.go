@@ -0,0 +1,155 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/fatih/color"
+	"github.com/glassechidna/ami-automation/shared"
+	"github.com/spf13/cobra"
+)
+
+var stopCmd = &cobra.Command{
+	Use:   "stop EXEC_ID",
+	Short: "Stop an SSM automation execution",
+	Long: `
+Stops an automation execution that was started elsewhere and shows its steps
+as it winds down. By default the execution is cancelled straight away; with
+--type Complete the current step is allowed to finish first.
+
+With --terminate-instances, any instances launched by the execution's
+aws:runInstances steps that are still around afterwards are terminated.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		stopType, _ := cmd.PersistentFlags().GetString("type")
+		terminate, _ := cmd.PersistentFlags().GetBool("terminate-instances")
+
+		execId := args[0]
+		sess := awsSession()
+
+		exitOnError(stop(sess, execId, stopType))
+
+		reporter := shared.NewStatusReporter(sess, execId)
+		reporter.Print()
+
+		if terminate {
+			exitOnError(terminateExecutionInstances(sess, execId))
+		}
+	},
+}
+
+// stop asks SSM to stop the execution, unless it has already finished.
+func stop(sess *session.Session, execId, stopType string) error {
+	if stopType != ssm.StopTypeCancel && stopType != ssm.StopTypeComplete {
+		return fmt.Errorf("unknown stop type '%s', expected %s or %s", stopType, ssm.StopTypeCancel, ssm.StopTypeComplete)
+	}
+
+	api := ssm.New(sess)
+
+	resp, err := api.GetAutomationExecution(&ssm.GetAutomationExecutionInput{AutomationExecutionId: &execId})
+	if err != nil { return err }
+
+	status := *resp.AutomationExecution.AutomationExecutionStatus
+	if shared.IsTerminalStatus(status) {
+		color.New(color.FgYellow).Fprintf(os.Stderr, "%s has already finished (%s)\n", execId, status)
+		return nil
+	}
+
+	_, err = api.StopAutomationExecution(&ssm.StopAutomationExecutionInput{
+		AutomationExecutionId: &execId,
+		Type:                  &stopType,
+	})
+	if err != nil { return err }
+
+	color.New(color.FgYellow).Fprintf(os.Stderr, "Stopping %s (%s)\n", execId, stopType)
+	return nil
+}
+
+// executionInstanceIds lists the instances launched by the execution's
+// aws:runInstances steps.
+func executionInstanceIds(sess *session.Session, execId string) ([]string, error) {
+	api := ssm.New(sess)
+
+	resp, err := api.GetAutomationExecution(&ssm.GetAutomationExecutionInput{AutomationExecutionId: &execId})
+	if err != nil { return nil, err }
+
+	ids := []string{}
+	for _, step := range resp.AutomationExecution.StepExecutions {
+		if aws.StringValue(step.Action) != "aws:runInstances" { continue }
+
+		for _, id := range step.Outputs["InstanceIds"] {
+			if id != nil && !stringInSlice(*id, ids) {
+				ids = append(ids, *id)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// terminateExecutionInstances terminates the instances the execution launched
+// that haven't already been terminated, e.g. by a later step of the document.
+func terminateExecutionInstances(sess *session.Session, execId string) error {
+	instanceIds, err := executionInstanceIds(sess, execId)
+	if err != nil { return err }
+
+	if len(instanceIds) == 0 {
+		color.New(color.FgBlue).Fprintln(os.Stderr, "No instances were launched by this execution")
+		return nil
+	}
+
+	api := ec2.New(sess)
+
+	resp, err := api.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(instanceIds),
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+		}},
+	})
+	if err != nil { return err }
+
+	remaining := []string{}
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			remaining = append(remaining, *instance.InstanceId)
+		}
+	}
+
+	if len(remaining) == 0 {
+		color.New(color.FgBlue).Fprintf(os.Stderr, "Instances [%s] are already terminated\n", strings.Join(instanceIds, ", "))
+		return nil
+	}
+
+	_, err = api.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: aws.StringSlice(remaining)})
+	if err != nil { return err }
+
+	color.New(color.FgYellow).Fprintf(os.Stderr, "Terminated instances [%s]\n", strings.Join(remaining, ", "))
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(stopCmd)
+	stopCmd.PersistentFlags().String("type", ssm.StopTypeCancel, "How to stop: Cancel (immediately) or Complete (after the current step)")
+	stopCmd.PersistentFlags().Bool("terminate-instances", false, "Terminate instances launched by the execution's aws:runInstances steps")
+}
@@ -0,0 +1,98 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// copyTemplateData is what name and description templates are rendered with,
+// e.g. "{{.Name}}-{{.Region}}".
+type copyTemplateData struct {
+	Name          string
+	Description   string
+	Region        string
+	SourceRegion  string
+	SourceImageId string
+	Tags          map[string]string
+}
+
+func renderTemplate(tmpl *template.Template, data copyTemplateData) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// matchesAny reports whether str matches any of the shell-style patterns.
+func matchesAny(patterns []string, str string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, str); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTags returns the tags whose keys match one of the include patterns
+// and none of the exclude patterns. AWS-reserved tags can't be set by us, so
+// they are always dropped.
+func filterTags(tags []*ec2.Tag, include, exclude []string) map[string]string {
+	ret := map[string]string{}
+
+	for _, tag := range tags {
+		key := aws.StringValue(tag.Key)
+		if strings.HasPrefix(key, "aws:") {
+			continue
+		}
+		if matchesAny(include, key) && !matchesAny(exclude, key) {
+			ret[key] = aws.StringValue(tag.Value)
+		}
+	}
+
+	return ret
+}
+
+func tagMap(tags []*ec2.Tag) map[string]string {
+	ret := map[string]string{}
+	for _, tag := range tags {
+		ret[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return ret
+}
+
+// ec2Tags converts a map of tags into EC2 API tags, sorted by key so that
+// requests are deterministic.
+func ec2Tags(tags map[string]string) []*ec2.Tag {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ret := []*ec2.Tag{}
+	for _, key := range keys {
+		ret = append(ret, &ec2.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return ret
+}
@@ -0,0 +1,67 @@
+// Copyright © 2017 Aidan Steele <aidan.steele@glassechidna.com.au>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var unshareCmd = &cobra.Command{
+	Use:   "unshare",
+	Short: "Revokes launch (and snapshot) permissions on an AMI",
+	Run: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.PersistentFlags())
+
+		amiId := viper.GetString("image-id")
+		targets := newShareTargets()
+
+		if targets.empty() {
+			fmt.Fprintln(os.Stderr, "Specify at least one account, organization or OU to unshare from")
+			os.Exit(1)
+		}
+
+		exitOnError(unshareAmi(awsSession(), amiId, targets))
+	},
+}
+
+// unshareAmi removes targets' launch permissions on the image and their
+// create volume permissions on its snapshots, printing the plan first.
+func unshareAmi(sess *session.Session, amiId string, targets shareTargets) error {
+	api := ec2.New(sess)
+
+	image, err := describeImage(sess, amiId)
+	if err != nil { return err }
+
+	color.New(color.FgBlue, color.Bold).Fprintf(os.Stderr, "Unsharing %s from %s\n", amiId, targets)
+
+	plan := planSharing(image, shareTargets{}, targets)
+	plan.print(*sess.Config.Region)
+
+	if err := plan.apply(api); err != nil { return err }
+	return plan.verify(api)
+}
+
+func init() {
+	utilCmd.AddCommand(unshareCmd)
+	unshareCmd.PersistentFlags().String("image-id", "", "AMI ID to unshare")
+	addShareTargetFlags(unshareCmd.PersistentFlags(), "unshare AMI from")
+}
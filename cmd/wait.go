@@ -20,51 +20,274 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"os"
 	"github.com/aws/aws-sdk-go/aws"
 	"time"
+	"github.com/fatih/color"
+	"github.com/spf13/pflag"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"strings"
+	"encoding/json"
+	"io"
+	"os"
+	"github.com/glassechidna/ami-automation/shared"
 )
 
 var waitCmd = &cobra.Command{
 	Use:   "wait",
 	Short: "Waits for an AMI (or multiple) to be available",
 	Run: func(cmd *cobra.Command, args []string) {
-		amiIds, _ := cmd.PersistentFlags().GetStringSlice("image-id")
-		regions, _ := cmd.PersistentFlags().GetStringSlice("region")
+		concurrency, _ := cmd.PersistentFlags().GetInt("concurrency")
+		timeout, _ := cmd.PersistentFlags().GetDuration("timeout")
+
+		sess := awsSession()
+		regionalAmis, err := regionalAmisFromFlags(cmd, sess)
+		exitOnError(err)
+
+		exitOnError(wait(sess, regionalAmis, concurrency, timeout))
+	},
+}
+
+// addRegionalAmiFlags defines the flags used by regionalAmisFromFlags.
+func addRegionalAmiFlags(flags *pflag.FlagSet) {
+	flags.StringSliceP("image-id", "i", []string{""}, "(Multiple) AMI IDs, or region:ami-id pairs")
+	flags.StringSliceP("region", "r", []string{""}, "(Multiple) Regions hosting AMI IDs (in same order). With a single source AMI ID, 'all' or a region group finds its copies")
+	flags.StringSlice("exclude-region", []string{""}, "(optional, multiple) Regions to leave out of 'all' or a region group")
+	flags.String("from-output", "", "Read AMI IDs from the JSON output of a previous 'start' (- for stdin)")
+	flags.Int("concurrency", 4, "Maximum number of regions to query at once")
+}
 
-		if len(amiIds) != len(regions) {
-			fmt.Fprintf(os.Stderr, "The number of AMIs (%d) must match the number of regions (%d)\n", len(amiIds), len(regions))
+// regionalAmisFromFlags works out which AMIs in which regions a command should
+// operate on. They come from region:ami-id pairs, the output of 'start' and
+// AMI IDs paired up in order with regions - unless a single (source) AMI ID is
+// given with a region alias, in which case its copies in those regions are
+// looked up.
+func regionalAmisFromFlags(cmd *cobra.Command, sess *session.Session) (map[string][]string, error) {
+	rawAmiIds, _ := cmd.PersistentFlags().GetStringSlice("image-id")
+	regions, _ := cmd.PersistentFlags().GetStringSlice("region")
+	excludes, _ := cmd.PersistentFlags().GetStringSlice("exclude-region")
+	fromOutput, _ := cmd.PersistentFlags().GetString("from-output")
+	concurrency, _ := cmd.PersistentFlags().GetInt("concurrency")
+
+	regionalAmis := map[string][]string{}
+	amiIds := []string{}
+	regions = nonEmpty(regions)
+
+	for _, raw := range nonEmpty(rawAmiIds) {
+		if pair := strings.SplitN(raw, ":", 2); len(pair) == 2 {
+			regionalAmis[pair[0]] = append(regionalAmis[pair[0]], pair[1])
+		} else {
+			amiIds = append(amiIds, raw)
 		}
+	}
+
+	if len(fromOutput) > 0 {
+		output, err := readOutput(fromOutput)
+		if err != nil { return nil, err }
 
-		regionalAmis := map[string]string{}
-		for idx := range amiIds {
-			regionalAmis[regions[idx]] = amiIds[idx]
+		for region, amiId := range output.AmiIds {
+			regionalAmis[region] = append(regionalAmis[region], amiId)
 		}
+	}
 
-		wait(awsSession(), regionalAmis)
-	},
+	if len(amiIds) == 0 && len(regions) == 0 {
+		if len(regionalAmis) == 0 {
+			return nil, fmt.Errorf("no AMIs given")
+		}
+		return regionalAmis, nil
+	}
+
+	if len(amiIds) == 1 && len(regionalAmis) == 0 {
+		resolved, err := resolveRegions(sess, regions, excludes)
+		if err != nil { return nil, err }
+
+		// an alias means "the copies in these regions", however many regions
+		// it turns out to cover
+		if usesRegionAlias(regions) || len(resolved) > 1 {
+			copies, err := findCopies(sess, amiIds[0], resolved, concurrency)
+			return amiLists(copies), err
+		}
+		regions = resolved
+	}
+
+	if len(amiIds) != len(regions) {
+		return nil, fmt.Errorf("the number of AMIs (%d) must match the number of regions (%d)", len(amiIds), len(regions))
+	}
+
+	for idx := range amiIds {
+		regionalAmis[regions[idx]] = append(regionalAmis[regions[idx]], amiIds[idx])
+	}
+
+	return regionalAmis, nil
+}
+
+// readOutput reads the JSON that 'start' prints, from a file or - for stdin.
+func readOutput(path string) (*shared.OutputFormat, error) {
+	var reader io.Reader = os.Stdin
+
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil { return nil, err }
+		defer file.Close()
+		reader = file
+	}
+
+	output := &shared.OutputFormat{}
+	if err := json.NewDecoder(reader).Decode(output); err != nil {
+		return nil, fmt.Errorf("couldn't read start output from %s: %s", path, err.Error())
+	}
+
+	return output, nil
 }
 
-func wait(sess *session.Session, amiIds map[string]string) {
+// amiLists converts a region -> AMI map into the region -> AMIs form that
+// wait takes.
+func amiLists(amiIds map[string]string) map[string][]string {
+	lists := map[string][]string{}
 	for region, amiId := range amiIds {
-		regionSess := sess.Copy(&aws.Config{Region: &region})
-		api := ec2.New(regionSess)
+		lists[region] = []string{amiId}
+	}
+	return lists
+}
+
+// wait blocks until every AMI is available. Every region is waited on at
+// once, so that each reports progress as it happens, but no more than
+// concurrency regions are polled at a time. It fails if any AMI fails, or if
+// they aren't all available within timeout (unless it is zero).
+func wait(sess *session.Session, amiIds map[string][]string, concurrency int, timeout time.Duration) error {
+	regions := []string{}
+	for region := range amiIds {
+		regions = append(regions, region)
+	}
+
+	limit := newLimiter(concurrency)
+
+	return eachRegion(regions, 0, func(region string) error {
+		return waitForImages(sess.Copy(&aws.Config{Region: &region}), amiIds[region], timeout, limit)
+	})
+}
+
+// waitForImage blocks until a single AMI in sess's region is available.
+func waitForImage(sess *session.Session, amiId string, timeout time.Duration, limit limiter) error {
+	return waitForImages(sess, []string{amiId}, timeout, limit)
+}
+
+// waitForImages blocks until the AMIs in sess's region are all available,
+// describing them in a single call per poll. While they're pending, the
+// progress of their snapshots is reported whenever it changes. Each poll's
+// API calls are made within limit.
+func waitForImages(sess *session.Session, amiIds []string, timeout time.Duration, limit limiter) error {
+	api := ec2.New(sess)
+	region := *sess.Config.Region
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
 
-		for {
-			resp, err := api.DescribeImages(&ec2.DescribeImagesInput{
-				ImageIds: []*string{ &amiId },
+	started := time.Now()
+	pending := append([]string{}, amiIds...)
+	lastProgress := map[string]string{}
+
+	for {
+		var resp *ec2.DescribeImagesOutput
+		err := limit.do(func() error {
+			var err error
+			resp, err = api.DescribeImages(&ec2.DescribeImagesInput{
+				ImageIds: aws.StringSlice(pending),
 			})
+			return err
+		})
+
+		// a freshly copied image can take a moment to be describable
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidAMIID.NotFound" && time.Since(started) < time.Minute {
+			resp, err = &ec2.DescribeImagesOutput{}, nil
+		}
+		if err != nil { return err }
+
+		images := map[string]*ec2.Image{}
+		for _, image := range resp.Images {
+			images[*image.ImageId] = image
+		}
+
+		stillPending := []string{}
+
+		for _, amiId := range pending {
+			image, ok := images[amiId]
+			if !ok {
+				// like InvalidAMIID.NotFound above, only tolerated at first
+				if time.Since(started) >= time.Minute {
+					return fmt.Errorf("%s not found", amiId)
+				}
+				stillPending = append(stillPending, amiId)
+				continue
+			}
+
+			switch *image.State {
+			case ec2.ImageStateAvailable:
+				regionProgress(color.New(color.FgGreen), region, "%s is available", amiId)
+			case ec2.ImageStateFailed, ec2.ImageStateError, ec2.ImageStateInvalid, ec2.ImageStateDeregistered:
+				reason := "no reason given"
+				if image.StateReason != nil {
+					reason = fmt.Sprintf("%s: %s", aws.StringValue(image.StateReason.Code), aws.StringValue(image.StateReason.Message))
+				}
+				return fmt.Errorf("%s is %s (%s)", amiId, *image.State, reason)
+			default:
+				stillPending = append(stillPending, amiId)
 
-			if err != nil { panic(err) }
-			if *resp.Images[0].State == ec2.ImageStateAvailable { break }
+				progress := ""
+				err := limit.do(func() error {
+					var err error
+					progress, err = snapshotProgress(api, image)
+					return err
+				})
+				if err != nil { return err }
 
-			time.Sleep(5 * time.Second)
+				if progress != lastProgress[amiId] {
+					lastProgress[amiId] = progress
+					regionProgress(color.New(color.FgBlue), region, "%s is %s%s", amiId, *image.State, progress)
+				}
+			}
 		}
+
+		pending = stillPending
+		if len(pending) == 0 { return nil }
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %v", timeout, pending)
+		}
+
+		time.Sleep(5 * time.Second)
 	}
 }
 
+// snapshotProgress describes how far along a pending image's snapshots are,
+// e.g. " (snap-123 45%, snap-456 80%)", or nothing if they aren't known yet.
+// Pending copies don't list their snapshots, so they're found by description.
+func snapshotProgress(api *ec2.EC2, image *ec2.Image) (string, error) {
+	var snapshots []*ec2.Snapshot
+
+	if snapshotIds := imageSnapshotIds(image); len(snapshotIds) > 0 {
+		resp, err := api.DescribeSnapshots(&ec2.DescribeSnapshotsInput{SnapshotIds: aws.StringSlice(snapshotIds)})
+		if err != nil { return "", err }
+		snapshots = resp.Snapshots
+	} else {
+		var err error
+		snapshots, err = copyingSnapshots(api, *image.ImageId)
+		if err != nil { return "", err }
+	}
+
+	if len(snapshots) == 0 { return "", nil }
+
+	parts := []string{}
+	for _, snapshot := range snapshots {
+		parts = append(parts, fmt.Sprintf("%s %s", *snapshot.SnapshotId, aws.StringValue(snapshot.Progress)))
+	}
+
+	return fmt.Sprintf(" (%s)", strings.Join(parts, ", ")), nil
+}
+
 func init() {
 	utilCmd.AddCommand(waitCmd)
-	waitCmd.PersistentFlags().StringSliceP("image-id", "i", []string{""}, "(Multiple) AMI IDs")
-	waitCmd.PersistentFlags().StringSliceP("region", "r", []string{""}, "(Multiple) Regions hosting AMI IDs (in same order)")
+	addRegionalAmiFlags(waitCmd.PersistentFlags())
+	waitCmd.PersistentFlags().Duration("timeout", 2 * time.Hour, "Give up if the AMIs aren't available after this long (0 to wait forever)")
 }
@@ -5,4 +5,15 @@ type OutputFormat struct {
 	AmiId string
 	AmiIds map[string]string
 	WaitCommand string `json:",omitempty"`
+	Snapshots map[string][]SnapshotState `json:",omitempty"`
+	AccountAmiIds map[string]map[string]string `json:",omitempty"`
+	// ExecutionIds are every attempt at the build, the successful one last
+	ExecutionIds []string `json:",omitempty"`
+}
+
+type SnapshotState struct {
+	DeviceName string
+	SnapshotId string
+	Encrypted bool
+	KmsKeyId string `json:",omitempty"`
 }
@@ -68,50 +68,75 @@ func prettyPrintedMaybeJson(input string) string {
 type RunCommandPrinter struct {}
 
 func (p *RunCommandPrinter) Print(file *os.File, sess *session.Session, step *ssm.StepExecution) error {
-	api := s3.New(sess)
-
 	color.New(color.FgBlue, color.Bold).Fprint(file, *step.StepName)
 	color.New(color.FgBlue).Fprintf(file, ": %s\n", *step.StepStatus)
 
+	outputs, err := RunCommandOutputs(sess, step)
+	if err != nil { return err }
+
+	for _, output := range outputs {
+		bodyColor := color.New(color.FgGreen)
+		if strings.HasSuffix(output.Key, "stderr") {
+			bodyColor = color.New(color.FgRed)
+		}
+
+		bodyColor.Fprintln(file, output.Body)
+	}
+
+	return nil
+}
+
+// CommandOutput is one of the stdout/stderr objects that a runCommand step
+// wrote to S3. Key is relative to the step's command ID.
+type CommandOutput struct {
+	Key string
+	Body string
+}
+
+// RunCommandOutputs fetches the output that a runCommand step wrote to S3,
+// which is nothing if it wasn't given an output bucket.
+func RunCommandOutputs(sess *session.Session, step *ssm.StepExecution) ([]CommandOutput, error) {
+	outputs := []CommandOutput{}
+
 	bucket := step.Inputs["OutputS3BucketName"]
+	commandId := step.Outputs["CommandId"]
+	if bucket == nil || len(commandId) == 0 { return outputs, nil }
 
-	if bucket != nil {
-		bucketName, err := strconv.Unquote(*bucket)
-		if err != nil { return err }
+	api := s3.New(sess)
 
-		commandId := step.Outputs["CommandId"]
-		keyPrefix := *commandId[0]
-		keyPrefixPtr := step.Inputs["OutputS3KeyPrefix"]
-		if keyPrefixPtr != nil {
-			keyPrefix = fmt.Sprintf("%s/%s", *keyPrefixPtr, keyPrefix)
-		}
+	bucketName, err := strconv.Unquote(*bucket)
+	if err != nil { return nil, err }
 
-		listResp, err := api.ListObjects(&s3.ListObjectsInput{
-			Bucket: &bucketName,
-			Prefix: &keyPrefix,
-		})
-		if err != nil { return err }
+	keyPrefix := *commandId[0]
+	keyPrefixPtr := step.Inputs["OutputS3KeyPrefix"]
+	if keyPrefixPtr != nil {
+		keyPrefix = fmt.Sprintf("%s/%s", *keyPrefixPtr, keyPrefix)
+	}
 
-		for _, object := range listResp.Contents {
-			getResp, err := api.GetObject(&s3.GetObjectInput{
-				Bucket: &bucketName,
-				Key: object.Key,
-			})
-			if err != nil { return err }
+	listResp, err := api.ListObjects(&s3.ListObjectsInput{
+		Bucket: &bucketName,
+		Prefix: &keyPrefix,
+	})
+	if err != nil { return nil, err }
 
-			body, err := ioutil.ReadAll(getResp.Body)
-			if err != nil { return err }
+	for _, object := range listResp.Contents {
+		getResp, err := api.GetObject(&s3.GetObjectInput{
+			Bucket: &bucketName,
+			Key: object.Key,
+		})
+		if err != nil { return nil, err }
 
-			bodyColor := color.New(color.FgGreen)
-			if strings.HasSuffix(*object.Key, "stderr") {
-				bodyColor = color.New(color.FgRed)
-			}
+		body, err := ioutil.ReadAll(getResp.Body)
+		getResp.Body.Close()
+		if err != nil { return nil, err }
 
-			bodyColor.Fprintln(file, string(body))
-		}
+		outputs = append(outputs, CommandOutput{
+			Key: strings.TrimPrefix(strings.TrimPrefix(*object.Key, keyPrefix), "/"),
+			Body: string(body),
+		})
 	}
 
-	return nil
+	return outputs, nil
 }
 
 type CreateImagePrinter struct {}
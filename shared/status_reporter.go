@@ -9,9 +9,10 @@ import (
 	"os"
 )
 
-func isTerminalStatus(status string) bool {
+// IsTerminalStatus reports whether an execution (or step) status is final.
+func IsTerminalStatus(status string) bool {
 	switch status {
-	case "Success", "TimedOut", "Cancelled", "Failed": return true
+	case "Success", "TimedOut", "Cancelled", "Failed", "Exited", "CompletedWithSuccess", "CompletedWithFailure": return true
 	default: return false
 	}
 }
@@ -29,11 +30,26 @@ func stringInSlice(str string, list []string) bool {
 	return false
 }
 
+// WaitingHandler is called once for each step that starts waiting on
+// something outside the execution, e.g. an aws:approve step.
+type WaitingHandler func(step *ssm.StepExecution)
+
+// IdleHandler is called on every poll of an interactive execution that has
+// pending steps but none running, with those pending steps in order.
+type IdleHandler func(pending []*ssm.StepExecution)
+
+// StepFilter decides whether a finished step is printed.
+type StepFilter func(step *ssm.StepExecution) bool
+
 type StatusReporter struct {
 	sess *session.Session
 	execId string
 	progress *os.File
 	results *os.File
+	onWaiting WaitingHandler
+	onIdle IdleHandler
+	follow bool
+	filter StepFilter
 }
 
 func NewStatusReporter(sess *session.Session, execId string) *StatusReporter {
@@ -42,9 +58,34 @@ func NewStatusReporter(sess *session.Session, execId string) *StatusReporter {
 		execId: execId,
 		progress: os.Stderr,
 		results: os.Stdout,
+		follow: true,
 	}
 }
 
+// OnWaiting sets a handler for steps that are waiting, e.g. to prompt for
+// approval.
+func (r *StatusReporter) OnWaiting(handler WaitingHandler) {
+	r.onWaiting = handler
+}
+
+// OnIdle sets a handler for when nothing is running, e.g. to start the next
+// step of an interactive execution.
+func (r *StatusReporter) OnIdle(handler IdleHandler) {
+	r.onIdle = handler
+}
+
+// SetFollow sets whether printing the steps keeps polling until the execution
+// finishes (the default) or stops after the steps that have finished so far.
+func (r *StatusReporter) SetFollow(follow bool) {
+	r.follow = follow
+}
+
+// FilterSteps limits the finished steps that are printed to those that filter
+// accepts.
+func (r *StatusReporter) FilterSteps(filter StepFilter) {
+	r.filter = filter
+}
+
 func (r *StatusReporter) Success() bool {
 	api := ssm.New(r.sess)
 	resp, _ := api.GetAutomationExecution(&ssm.GetAutomationExecutionInput{
@@ -73,6 +114,7 @@ func (r *StatusReporter) PrintSteps() {
 	api := ssm.New(r.sess)
 
 	printedSteps := []string{}
+	waitedSteps := []string{}
 
 	for {
 		resp, err := api.GetAutomationExecution(&ssm.GetAutomationExecutionInput{
@@ -81,20 +123,57 @@ func (r *StatusReporter) PrintSteps() {
 		if err != nil { log.Panicf(err.Error()) }
 
 		for _, step := range resp.AutomationExecution.StepExecutions {
-			if isTerminalStatus(*step.StepStatus) && !stringInSlice(*step.StepName, printedSteps) {
+			if IsTerminalStatus(*step.StepStatus) && !stringInSlice(*step.StepName, printedSteps) {
 				printedSteps = append(printedSteps, *step.StepName)
-				r.PrintStep(step)
+				if r.filter == nil || r.filter(step) {
+					r.PrintStep(step)
+				}
+			}
+
+			if *step.StepStatus == "Waiting" && r.onWaiting != nil && !stringInSlice(*step.StepName, waitedSteps) {
+				waitedSteps = append(waitedSteps, *step.StepName)
+				r.onWaiting(step)
 			}
 		}
 
-		if isTerminalStatus(*resp.AutomationExecution.AutomationExecutionStatus) {
+		status := *resp.AutomationExecution.AutomationExecutionStatus
+		if IsTerminalStatus(status) {
+			break
+		}
+
+		if !r.follow {
+			color.New(color.FgYellow).Fprintf(r.progress, "Execution is still %s\n", status)
 			break
 		}
 
+		if r.onIdle != nil {
+			if pending, idle := pendingSteps(resp.AutomationExecution); idle && len(pending) > 0 {
+				r.onIdle(pending)
+			}
+		}
+
 		time.Sleep(5 * time.Second)
 	}
 }
 
+// pendingSteps returns the steps yet to start, and whether no step is
+// currently running.
+func pendingSteps(exec *ssm.AutomationExecution) ([]*ssm.StepExecution, bool) {
+	pending := []*ssm.StepExecution{}
+	idle := true
+
+	for _, step := range exec.StepExecutions {
+		switch *step.StepStatus {
+		case "Pending":
+			pending = append(pending, step)
+		case "InProgress", "Waiting":
+			idle = false
+		}
+	}
+
+	return pending, idle
+}
+
 func printerForType(stepType string) StepPrinter {
 	switch stepType {
 	case "aws:runCommand":